@@ -0,0 +1,365 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// SFNodeNetwork is set by nodes that store and serve the full chain
+const SFNodeNetwork uint64 = 1 << 0
+
+// The address book is split into a new table, for addresses only heard of,
+// and a tried table, for addresses we have connected to. Which bucket an
+// address lands in is a keyed hash of its network group and, for the new
+// table, of the group of the peer that told us about it. A single peer, or
+// many peers on one network, can therefore only fill a few buckets and
+// cannot push the addresses we know to work out of the tables.
+const (
+	newBucketCount           = 256
+	triedBucketCount         = 64
+	bucketSize               = 64
+	newBucketsPerSourceGroup = 8
+	triedBucketsPerGroup     = 8
+
+	// addresses not heard of for this long are dropped first
+	addressHorizon = 30 * 24 * time.Hour
+)
+
+const (
+	// maxAddrPerMsg is the most addresses one addr message may carry
+	maxAddrPerMsg = 1000
+	// a getaddr is answered with getAddrPercent of the known addresses,
+	// but at least getAddrMinimum of them
+	getAddrPercent = 23
+	getAddrMinimum = 10
+	// addr messages with at most maxAddrToRelay addresses are announcements
+	// of new nodes and are passed on to addrRelayFanout random peers, as
+	// long as the addresses were online within addrRelayAge
+	maxAddrToRelay  = 10
+	addrRelayFanout = 2
+	addrRelayAge    = 10 * time.Minute
+)
+
+// netAddress is a node address as gossiped between peers
+type netAddress struct {
+	Addr string
+	// Timestamp is when the node was last known to be online
+	Timestamp int64
+	Services  uint64
+}
+
+func newNetAddress(addr string, services uint64) netAddress {
+	return netAddress{addr, time.Now().Unix(), services}
+}
+
+// knownAddress is an entry of the address book, persisted in the peers bucket
+type knownAddress struct {
+	Addr      string
+	Timestamp int64
+	Services  uint64
+	// Source is the host that told us about the address
+	Source string
+	// Tried is set once a connection to the address succeeded
+	Tried bool
+	// LastSeen is when a connection to the address last succeeded
+	LastSeen int64
+	// LastAttempt is when the address was last dialed or dropped
+	LastAttempt int64
+	// Attempts counts the failed dials since the last success
+	Attempts int
+}
+
+func (ka *knownAddress) netAddress() netAddress {
+	return netAddress{ka.Addr, ka.Timestamp, ka.Services}
+}
+
+// retryDelay is how long to wait after LastAttempt before dialing again
+func (ka *knownAddress) retryDelay() time.Duration {
+	if ka.Attempts == 0 {
+		return 0
+	}
+	delay := baseRetryDelay
+	for i := 1; i < ka.Attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// isTerrible reports whether the address is not worth keeping: not heard
+// of for a long time or failing every time it is dialed
+func (ka *knownAddress) isTerrible(now int64) bool {
+	if ka.LastAttempt > now-60 {
+		return false
+	}
+	if ka.Timestamp < now-int64(addressHorizon/time.Second) {
+		return true
+	}
+	if ka.LastSeen == 0 && ka.Attempts >= 3 {
+		return true
+	}
+	return ka.Attempts >= 10
+}
+
+func (ka *knownAddress) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(ka)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return result.Bytes()
+}
+
+func deserializeKnownAddress(data []byte) *knownAddress {
+	var ka knownAddress
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&ka)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return &ka
+}
+
+// addressGroup returns the network an address belongs to: the /16 of an
+// IPv4 address, the /32 of an IPv6 address, or the host name itself
+func addressGroup(addr string) string {
+	host := hostOf(addr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// addrManager holds the new and tried tables. It does no locking, the
+// PeerManager guards it.
+type addrManager struct {
+	key        []byte
+	addresses  map[string]*knownAddress
+	newTable   [newBucketCount]map[string]*knownAddress
+	triedTable [triedBucketCount]map[string]*knownAddress
+}
+
+func newAddrManager(key []byte) *addrManager {
+	a := &addrManager{
+		key:       key,
+		addresses: make(map[string]*knownAddress),
+	}
+	for i := range a.newTable {
+		a.newTable[i] = make(map[string]*knownAddress)
+	}
+	for i := range a.triedTable {
+		a.triedTable[i] = make(map[string]*knownAddress)
+	}
+	return a
+}
+
+func (a *addrManager) keyedHash(parts ...string) uint64 {
+	h := sha256.New()
+	h.Write(a.key)
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (a *addrManager) newBucket(ka *knownAddress) int {
+	sourceGroup := addressGroup(ka.Source)
+	slot := a.keyedHash(addressGroup(ka.Addr), sourceGroup) % newBucketsPerSourceGroup
+	return int(a.keyedHash(sourceGroup, string(rune(slot))) % newBucketCount)
+}
+
+func (a *addrManager) triedBucket(ka *knownAddress) int {
+	slot := a.keyedHash(ka.Addr) % triedBucketsPerGroup
+	return int(a.keyedHash(addressGroup(ka.Addr), string(rune(slot))) % triedBucketCount)
+}
+
+// load puts an entry read from the database back into its table and
+// returns the addresses that had to be dropped to make room
+func (a *addrManager) load(ka *knownAddress) []string {
+	if ka.Tried {
+		bucket := a.triedTable[a.triedBucket(ka)]
+		if len(bucket) < bucketSize {
+			bucket[ka.Addr] = ka
+			a.addresses[ka.Addr] = ka
+			return nil
+		}
+		ka.Tried = false
+	}
+	return a.insertNew(ka)
+}
+
+// insertNew puts ka in its new bucket, evicting a terrible or the stalest
+// entry when the bucket is full
+func (a *addrManager) insertNew(ka *knownAddress) []string {
+	var evicted []string
+	bucket := a.newTable[a.newBucket(ka)]
+	if len(bucket) >= bucketSize {
+		now := time.Now().Unix()
+		var victim *knownAddress
+		for _, other := range bucket {
+			if other.isTerrible(now) {
+				victim = other
+				break
+			}
+			if victim == nil || other.Timestamp < victim.Timestamp {
+				victim = other
+			}
+		}
+		delete(bucket, victim.Addr)
+		delete(a.addresses, victim.Addr)
+		evicted = append(evicted, victim.Addr)
+	}
+	bucket[ka.Addr] = ka
+	a.addresses[ka.Addr] = ka
+	return evicted
+}
+
+// add records an address heard of from source. It returns the entry, nil
+// for unusable addresses, whether the address was new to us and the
+// addresses evicted to make room for it.
+func (a *addrManager) add(na netAddress, source string) (*knownAddress, bool, []string) {
+	if _, _, err := net.SplitHostPort(na.Addr); err != nil {
+		return nil, false, nil
+	}
+	now := time.Now().Unix()
+	if na.Timestamp > now+10*60 || na.Timestamp <= 0 {
+		// an impossible timestamp, treat the address as barely alive
+		na.Timestamp = now - 5*24*60*60
+	}
+
+	if ka, ok := a.addresses[na.Addr]; ok {
+		if na.Timestamp > ka.Timestamp {
+			ka.Timestamp = na.Timestamp
+		}
+		ka.Services |= na.Services
+		return ka, false, nil
+	}
+
+	ka := &knownAddress{
+		Addr:      na.Addr,
+		Timestamp: na.Timestamp,
+		Services:  na.Services,
+		Source:    source,
+	}
+	return ka, true, a.insertNew(ka)
+}
+
+// markGood moves addr to the tried table after a successful connection.
+// When its tried bucket is full the entry seen longest ago goes back to
+// the new table. It returns the entries that changed and the addresses
+// evicted.
+func (a *addrManager) markGood(addr string) ([]*knownAddress, []string) {
+	ka, ok := a.addresses[addr]
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now().Unix()
+	ka.LastSeen = now
+	ka.LastAttempt = now
+	ka.Timestamp = now
+	ka.Attempts = 0
+	if ka.Tried {
+		return []*knownAddress{ka}, nil
+	}
+
+	delete(a.newTable[a.newBucket(ka)], addr)
+	changed := []*knownAddress{ka}
+	var evicted []string
+	bucket := a.triedTable[a.triedBucket(ka)]
+	if len(bucket) >= bucketSize {
+		var victim *knownAddress
+		for _, other := range bucket {
+			if victim == nil || other.LastSeen < victim.LastSeen {
+				victim = other
+			}
+		}
+		delete(bucket, victim.Addr)
+		victim.Tried = false
+		evicted = a.insertNew(victim)
+		changed = append(changed, victim)
+	}
+	ka.Tried = true
+	bucket[addr] = ka
+	return changed, evicted
+}
+
+// markAttempt records a failed dial or a dropped connection
+func (a *addrManager) markAttempt(addr string) *knownAddress {
+	ka, ok := a.addresses[addr]
+	if !ok {
+		return nil
+	}
+	ka.LastAttempt = time.Now().Unix()
+	ka.Attempts++
+	return ka
+}
+
+// sample returns a random selection of the addresses worth sharing, at
+// most max and about getAddrPercent of the table
+func (a *addrManager) sample(max int) []netAddress {
+	now := time.Now().Unix()
+	var all []netAddress
+	for _, ka := range a.addresses {
+		if !ka.isTerrible(now) {
+			all = append(all, ka.netAddress())
+		}
+	}
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+
+	n := len(all) * getAddrPercent / 100
+	if n < getAddrMinimum {
+		n = getAddrMinimum
+	}
+	if n > max {
+		n = max
+	}
+	if n > len(all) {
+		n = len(all)
+	}
+	return all[:n]
+}
+
+// dialCandidates returns addresses to dial in the order to try them,
+// alternating between the tried and the new table
+func (a *addrManager) dialCandidates(skip func(ka *knownAddress) bool) []string {
+	var tried, fresh []string
+	for addr, ka := range a.addresses {
+		if skip(ka) {
+			continue
+		}
+		if ka.Tried {
+			tried = append(tried, addr)
+		} else {
+			fresh = append(fresh, addr)
+		}
+	}
+	rand.Shuffle(len(tried), func(i, j int) { tried[i], tried[j] = tried[j], tried[i] })
+	rand.Shuffle(len(fresh), func(i, j int) { fresh[i], fresh[j] = fresh[j], fresh[i] })
+
+	var candidates []string
+	for len(tried) > 0 || len(fresh) > 0 {
+		if len(tried) > 0 {
+			candidates = append(candidates, tried[0])
+			tried = tried[1:]
+		}
+		if len(fresh) > 0 {
+			candidates = append(candidates, fresh[0])
+			fresh = fresh[1:]
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,53 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrManagerPoisoning(t *testing.T) {
+	a := newAddrManager([]byte("test key"))
+
+	good := newNetAddress("10.1.0.1:3000", SFNodeNetwork)
+	_, isNew, _ := a.add(good, "10.2.0.1:3000")
+	assert.True(t, isNew)
+	a.markGood(good.Addr)
+	assert.True(t, a.addresses[good.Addr].Tried)
+
+	// one attacker announcing addresses from many networks can only fill
+	// the few new buckets its own network maps to
+	for i := 0; i < 20000; i++ {
+		na := newNetAddress(fmt.Sprintf("%d.%d.%d.1:3000", 20+i%200, i/200%256, i%256), SFNodeNetwork)
+		a.add(na, "66.66.0.1:3000")
+	}
+	assert.LessOrEqual(t, len(a.addresses), 1+newBucketsPerSourceGroup*bucketSize)
+	assert.Contains(t, a.addresses, good.Addr, "tried addresses survive the flood")
+}
+
+func TestAddrManagerAdd(t *testing.T) {
+	a := newAddrManager([]byte("test key"))
+	now := time.Now().Unix()
+
+	ka, isNew, _ := a.add(netAddress{"10.1.0.1:3000", now + 3600, 0}, "10.2.0.1:3000")
+	assert.True(t, isNew)
+	assert.Less(t, ka.Timestamp, now, "timestamps in the future are not trusted")
+
+	ka, isNew, _ = a.add(netAddress{"10.1.0.1:3000", now, SFNodeNetwork}, "10.3.0.1:3000")
+	assert.False(t, isNew, "addresses are deduplicated")
+	assert.Equal(t, now, ka.Timestamp)
+	assert.Equal(t, SFNodeNetwork, ka.Services)
+	assert.Equal(t, "10.2.0.1:3000", ka.Source)
+
+	ka, _, _ = a.add(netAddress{"not an address", now, 0}, "10.2.0.1:3000")
+	assert.Nil(t, ka)
+	assert.Len(t, a.addresses, 1)
+
+	for i := 0; i < 200; i++ {
+		a.add(newNetAddress(fmt.Sprintf("10.%d.0.1:3000", i), 0), fmt.Sprintf("11.%d.0.1:3000", i))
+	}
+	assert.Len(t, a.sample(maxAddrPerMsg), len(a.addresses)*getAddrPercent/100)
+	assert.Len(t, a.sample(5), 5)
+}
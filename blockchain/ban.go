@@ -0,0 +1,206 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"github.com/boltdb/bolt"
+	"log"
+	"net"
+	"time"
+)
+
+const bansBucket = "bans"
+
+// banThreshold is the misbehavior score at which a peer is banned
+const banThreshold = 100
+
+// defaultBanDuration is how long a ban lasts unless startnode -bantime is set
+const defaultBanDuration = 24 * time.Hour
+
+// Misbehavior scores for the protocol violations a peer can commit
+const (
+	banScoreMalformedMessage = 100
+	banScoreInvalidBlock     = 100
+	banScoreInvalidTx        = 100
+	banScoreOversizedMessage = 20
+)
+
+var banDuration = defaultBanDuration
+
+var ErrBanned = errors.New("address is banned")
+
+// banEntry is a ban of one host, or of one address of a local host,
+// persisted in the bans bucket
+type banEntry struct {
+	Host   string
+	Until  int64
+	Reason string
+}
+
+func (b *banEntry) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(b)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return result.Bytes()
+}
+
+func deserializeBanEntry(data []byte) *banEntry {
+	var b banEntry
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&b)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return &b
+}
+
+// hostOf strips the port from addr
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// banKey returns what a ban of the peer at addr applies to: its host, so
+// every connection from a banned machine is refused. Loopback and private
+// hosts keep the port, since several local nodes share one IP and are only
+// told apart by it.
+func banKey(addr string) string {
+	host := hostOf(addr)
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+		return addr
+	}
+	return host
+}
+
+// banKey returns the key a ban of p is stored under. An inbound peer is
+// known by the address it listens on once its version message named one,
+// as it connects from a new port every time. The caller holds the
+// manager's lock.
+func (p *Peer) banKey() string {
+	if p.inbound && p.listenAddr != "" {
+		return banKey(p.listenAddr)
+	}
+	return banKey(p.addr)
+}
+
+// loadBans returns the bans that have not expired yet
+func loadBans(db *bolt.DB) []*banEntry {
+	var bans []*banEntry
+	now := time.Now().Unix()
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bansBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			ban := deserializeBanEntry(v)
+			if ban.Until > now {
+				bans = append(bans, ban)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	return bans
+}
+
+// deleteBans lifts the ban of host, or every ban when host is empty, and
+// returns how many were lifted
+func deleteBans(db *bolt.DB, host string) int {
+	deleted := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bansBucket))
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if host == "" || string(k) == host {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	return deleted
+}
+
+// Misbehaving adds points to the ban score of p. Once the score reaches
+// banThreshold p is banned, see Peer.banKey, and disconnected.
+func (pm *PeerManager) Misbehaving(p *Peer, points int, reason string) {
+	pm.mu.Lock()
+	p.banScore += points
+	score := p.banScore
+	key := p.banKey()
+	pm.mu.Unlock()
+
+	log.Printf("Misbehavior by %s: %s, ban score is now %d\n", p, reason, score)
+	if score >= banThreshold {
+		pm.Ban(key, reason)
+		p.Disconnect()
+	}
+}
+
+// Ban refuses connections from and to host, a key made by banKey, for
+// banDuration
+func (pm *PeerManager) Ban(host, reason string) {
+	ban := &banEntry{
+		Host:   host,
+		Until:  time.Now().Add(banDuration).Unix(),
+		Reason: reason,
+	}
+
+	pm.mu.Lock()
+	pm.bans[host] = ban
+	pm.mu.Unlock()
+
+	err := pm.bc.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bansBucket)).Put([]byte(host), ban.Serialize())
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	log.Printf("Banned %s until %s: %s\n", host, time.Unix(ban.Until, 0).Format(time.RFC3339), reason)
+}
+
+// IsBanned reports whether host is banned right now
+func (pm *PeerManager) IsBanned(host string) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.isBanned(host)
+}
+
+func (pm *PeerManager) isBanned(host string) bool {
+	ban, ok := pm.bans[host]
+	if !ok {
+		return false
+	}
+	if ban.Until <= time.Now().Unix() {
+		delete(pm.bans, host)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanThreshold(t *testing.T) {
+	bc, _ := newTestChain(t)
+	oldMempool, oldSyncManager := mempool, syncManager
+	t.Cleanup(func() { mempool, syncManager = oldMempool, oldSyncManager })
+	mempool = NewMempool(bc)
+	syncManager = NewSyncManager(bc)
+
+	tests := []struct {
+		scores []int
+		banned bool
+	}{
+		{[]int{banScoreOversizedMessage}, false},
+		{[]int{banScoreOversizedMessage, banScoreOversizedMessage, banScoreOversizedMessage, banScoreOversizedMessage}, false},
+		{[]int{banScoreOversizedMessage, banScoreOversizedMessage, banScoreOversizedMessage, banScoreOversizedMessage, banScoreOversizedMessage}, true},
+		{[]int{banScoreInvalidBlock}, true},
+	}
+	for _, test := range tests {
+		pm := NewPeerManager(bc, nil)
+		conn, remote := net.Pipe()
+		defer remote.Close()
+		p := newPeer(pm, conn, "peer:3000", true)
+		for _, score := range test.scores {
+			pm.Misbehaving(p, score, "test")
+		}
+
+		assert.Equal(t, test.banned, pm.IsBanned(banKey(p.addr)), "scores %v", test.scores)
+		select {
+		case <-p.Done():
+			assert.True(t, test.banned, "only a banned peer is disconnected")
+		default:
+			assert.False(t, test.banned, "a banned peer is disconnected")
+		}
+		deleteBans(bc.Db, "")
+	}
+}
+
+func TestBanKey(t *testing.T) {
+	tests := []struct {
+		addr string
+		key  string
+	}{
+		{"203.0.113.5:3000", "203.0.113.5"},
+		{"[2001:db8::1]:3000", "2001:db8::1"},
+		{"seed.example.com:3000", "seed.example.com"},
+		{"localhost:3000", "localhost:3000"},
+		{"127.0.0.1:3000", "127.0.0.1:3000"},
+		{"[::1]:3000", "[::1]:3000"},
+		{"192.168.1.5:3000", "192.168.1.5:3000"},
+		{"10.1.0.1:3000", "10.1.0.1:3000"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.key, banKey(test.addr), test.addr)
+	}
+}
+
+func TestBanPeersOnOneHost(t *testing.T) {
+	bc, _ := newTestChain(t)
+	oldMempool, oldSyncManager := mempool, syncManager
+	t.Cleanup(func() { mempool, syncManager = oldMempool, oldSyncManager })
+	mempool = NewMempool(bc)
+	syncManager = NewSyncManager(bc)
+	pm := NewPeerManager(bc, nil)
+
+	tests := []struct {
+		offender, other string
+		otherBanned     bool
+	}{
+		// local nodes are told apart by port
+		{"localhost:3001", "localhost:3002", false},
+		{"127.0.0.1:3001", "127.0.0.1:3002", false},
+		{"203.0.113.5:3001", "203.0.113.5:3002", true},
+	}
+	for _, test := range tests {
+		conn, remote := net.Pipe()
+		defer remote.Close()
+		p := newPeer(pm, conn, test.offender, false)
+		pm.Misbehaving(p, banScoreInvalidTx, "test")
+
+		assert.True(t, pm.IsBanned(banKey(test.offender)))
+		assert.Equal(t, test.otherBanned, pm.IsBanned(banKey(test.other)), test.other)
+		pm.AddAddresses([]netAddress{newNetAddress(test.offender, SFNodeNetwork)}, "")
+	}
+	assert.Equal(t, len(tests), pm.AddressCount())
+	pm.fillOutbound()
+	assert.Empty(t, pm.dialing, "banned addresses are not dialed")
+
+	// an inbound local peer connects from a new port, its listen address
+	// gives it away
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := newPeer(pm, conn, "127.0.0.1:51234", true)
+	assert.ErrorIs(t, pm.setListenAddr(p, "localhost:3001"), ErrBanned)
+	assert.NoError(t, pm.setListenAddr(p, "localhost:3002"))
+	pm.Misbehaving(p, banThreshold, "test")
+	assert.True(t, pm.IsBanned("localhost:3002"))
+	assert.False(t, pm.IsBanned("127.0.0.1:51234"))
+}
+
+func TestBanExpiry(t *testing.T) {
+	bc, _ := newTestChain(t)
+	pm := NewPeerManager(bc, nil)
+	pm.Ban("expired", "test")
+	pm.Ban("active", "test")
+	pm.bans["expired"].Until = time.Now().Unix()
+
+	reloaded := NewPeerManager(bc, nil)
+	assert.True(t, reloaded.IsBanned("active"), "bans are persisted")
+	assert.False(t, pm.IsBanned("expired"))
+	assert.NotContains(t, pm.bans, "expired", "an expired ban is dropped")
+
+	oldBanDuration := banDuration
+	t.Cleanup(func() { banDuration = oldBanDuration })
+	banDuration = -time.Second
+	pm.Ban("expired", "test")
+	assert.Len(t, loadBans(bc.Db), 1, "expired bans are not loaded")
+	assert.Equal(t, 2, deleteBans(bc.Db, ""))
+}
@@ -0,0 +1,41 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBase58RoundTrip(t *testing.T) {
+	tests := []struct {
+		input   []byte
+		encoded string
+	}{
+		{[]byte{}, ""},
+		{[]byte{0}, "1"},
+		{[]byte{0, 0, 1}, "112"},
+		{[]byte{0, 0, 0, 57}, "111z"},
+		{[]byte{1, 0}, "5R"},
+	}
+	for _, test := range tests {
+		encoded := Base58Encode(test.input)
+		assert.Equal(t, test.encoded, string(encoded))
+		assert.Equal(t, test.input, Base58Decode(encoded), "every leading zero byte survives")
+	}
+}
+
+func TestAddressWithLeadingZeros(t *testing.T) {
+	for _, pubKeyHash := range [][]byte{
+		append([]byte{0}, bytes.Repeat([]byte{7}, 19)...),
+		append([]byte{0, 0, 0}, bytes.Repeat([]byte{7}, 17)...),
+	} {
+		payload := append([]byte{version}, pubKeyHash...)
+		address := Base58Encode(append(payload, checksum(payload)...))
+		assert.True(t, ValidateAddress(string(address)))
+
+		var out TXOutput
+		out.Lock(address)
+		assert.Equal(t, pubKeyHash, out.PubKeyHash, "the output pays the hash the address names")
+	}
+}
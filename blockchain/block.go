@@ -12,10 +12,37 @@ type Block struct {
 	Transactions []*Transaction
 	PreBlockHash []byte
 	Hash         []byte
+	Bits         uint32
 	Nonce        int
 	Height       int
 }
 
+// BlockHeader is everything the proof of work commits to, with the
+// transactions replaced by their merkle root. Headers are downloaded and
+// checked before the blocks they belong to.
+type BlockHeader struct {
+	Timestamp    int64
+	PreBlockHash []byte
+	MerkleRoot   []byte
+	Hash         []byte
+	Bits         uint32
+	Nonce        int
+	Height       int
+}
+
+// Header returns the header of the block
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		Timestamp:    b.Timestamp,
+		PreBlockHash: b.PreBlockHash,
+		MerkleRoot:   b.HashTransactions(),
+		Hash:         b.Hash,
+		Bits:         b.Bits,
+		Nonce:        b.Nonce,
+		Height:       b.Height,
+	}
+}
+
 func (b *Block) Serialize() []byte {
 	var result bytes.Buffer
 	encoder := gob.NewEncoder(&result)
@@ -44,18 +71,19 @@ func DeSerializeBlock(d []byte) *Block {
 func (b *Block) HashTransactions() []byte {
 	var txHashes [][]byte
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		txHashes = append(txHashes, tx.hashData())
 	}
 	tree := NewMerkleTree(txHashes)
 	return tree.RootNode.Data
 }
 
-func NewBlock(transactions []*Transaction, preBlockHash []byte, height int) *Block {
+func NewBlock(transactions []*Transaction, preBlockHash []byte, height int, bits uint32, timestamp int64) *Block {
 	block := &Block{
-		time.Now().Unix(),
+		timestamp,
 		transactions,
 		preBlockHash,
 		[]byte{},
+		bits,
 		0,
 		height,
 	}
@@ -67,5 +95,5 @@ func NewBlock(transactions []*Transaction, preBlockHash []byte, height int) *Blo
 }
 
 func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, activeNetParams.PowLimitBits, time.Now().Unix())
 }
@@ -0,0 +1,261 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/boltdb/bolt"
+	"log"
+	"math/big"
+	"sort"
+)
+
+const blockIndexBucket = "blockindex"
+
+// mainChainBucket maps every height of the main chain to its block hash
+const mainChainBucket = "mainchain"
+
+// medianTimeBlocks is how many blocks the median time past is taken over
+const medianTimeBlocks = 11
+
+// blockNode is the block index entry of a block or a validated header.
+// ChainWork is the total work of the chain ending at the block and decides
+// the best chain.
+type blockNode struct {
+	Hash         []byte
+	PreBlockHash []byte
+	Height       int
+	Timestamp    int64
+	Bits         uint32
+	ChainWork    *big.Int
+	// HeaderOnly is set while the block's transactions are not downloaded
+	HeaderOnly bool
+	// Invalid is set when the block or one of its ancestors failed to
+	// connect
+	Invalid bool
+}
+
+func newBlockNode(block *Block, parent *blockNode) *blockNode {
+	node := newHeaderNode(block.Header(), parent)
+	node.HeaderOnly = false
+	return node
+}
+
+func newHeaderNode(header *BlockHeader, parent *blockNode) *blockNode {
+	work := NewHeaderProofOfWork(header).Work()
+	if parent != nil {
+		work.Add(work, parent.ChainWork)
+	}
+	return &blockNode{
+		Hash:         header.Hash,
+		PreBlockHash: header.PreBlockHash,
+		Height:       header.Height,
+		Timestamp:    header.Timestamp,
+		Bits:         header.Bits,
+		ChainWork:    work,
+		HeaderOnly:   true,
+	}
+}
+
+// betterThan reports whether the chain ending at n should be preferred over
+// the one ending at other. Ties in work go to the lower block hash so every
+// node settles on the same tip.
+func (n *blockNode) betterThan(other *blockNode) bool {
+	cmp := n.ChainWork.Cmp(other.ChainWork)
+	if cmp != 0 {
+		return cmp > 0
+	}
+	return bytes.Compare(n.Hash, other.Hash) < 0
+}
+
+// tipNode returns the index entry of the main chain tip
+func tipNode(tx *bolt.Tx) *blockNode {
+	return getBlockNode(tx, tx.Bucket([]byte(blockBucket)).Get([]byte("l")))
+}
+
+// calcPastMedianTime returns the median timestamp of node and up to ten of
+// its ancestors. A block's timestamp must be later than this value.
+func calcPastMedianTime(tx *bolt.Tx, node *blockNode) int64 {
+	var timestamps []int64
+	for i := 0; i < medianTimeBlocks && node != nil; i++ {
+		timestamps = append(timestamps, node.Timestamp)
+		if len(node.PreBlockHash) == 0 {
+			break
+		}
+		node = getBlockNode(tx, node.PreBlockHash)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+func (n *blockNode) Serialize() []byte {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(n)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return buf.Bytes()
+}
+
+func deserializeBlockNode(data []byte) *blockNode {
+	var node blockNode
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&node)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return &node
+}
+
+func getBlockNode(tx *bolt.Tx, hash []byte) *blockNode {
+	data := tx.Bucket([]byte(blockIndexBucket)).Get(hash)
+	if data == nil {
+		return nil
+	}
+	return deserializeBlockNode(data)
+}
+
+func putBlockNode(tx *bolt.Tx, node *blockNode) {
+	err := tx.Bucket([]byte(blockIndexBucket)).Put(node.Hash, node.Serialize())
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+// markInvalid flags node and every indexed block descending from it as
+// invalid, so they are rejected before anything tries to connect them again
+func markInvalid(tx *bolt.Tx, node *blockNode) {
+	node.Invalid = true
+	putBlockNode(tx, node)
+
+	var descendants []*blockNode
+	err := tx.Bucket([]byte(blockIndexBucket)).ForEach(func(k, v []byte) error {
+		candidate := deserializeBlockNode(v)
+		if candidate.Height > node.Height && !candidate.Invalid {
+			descendants = append(descendants, candidate)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	sort.Slice(descendants, func(i, j int) bool { return descendants[i].Height < descendants[j].Height })
+
+	invalid := map[string]bool{string(node.Hash): true}
+	for _, d := range descendants {
+		if invalid[string(d.PreBlockHash)] {
+			invalid[string(d.Hash)] = true
+			d.Invalid = true
+			putBlockNode(tx, d)
+		}
+	}
+}
+
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+// mainChainHash returns the hash of the main chain block at height, or nil
+// when the chain is shorter
+func mainChainHash(tx *bolt.Tx, height int) []byte {
+	return tx.Bucket([]byte(mainChainBucket)).Get(heightKey(height))
+}
+
+func inMainChain(tx *bolt.Tx, node *blockNode) bool {
+	return bytes.Equal(mainChainHash(tx, node.Height), node.Hash)
+}
+
+// ancestor returns the ancestor of node at height. Once the walk back
+// reaches the main chain it jumps there through the main chain index.
+func ancestor(tx *bolt.Tx, node *blockNode, height int) *blockNode {
+	for node != nil && node.Height > height {
+		if inMainChain(tx, node) {
+			return getBlockNode(tx, mainChainHash(tx, height))
+		}
+		node = getBlockNode(tx, node.PreBlockHash)
+	}
+	return node
+}
+
+// blockLocator describes the chain ending at node to a peer: the ten
+// latest hashes, then exponentially sparser ones back to genesis, so the
+// last block both chains share can be found in one round trip
+func blockLocator(tx *bolt.Tx, node *blockNode) [][]byte {
+	var locator [][]byte
+	step := 1
+	for node != nil {
+		locator = append(locator, node.Hash)
+		if node.Height == 0 {
+			break
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		height := node.Height - step
+		if height < 0 {
+			height = 0
+		}
+		node = ancestor(tx, node, height)
+	}
+	return locator
+}
+
+// findFork returns the first locator entry on the main chain, falling back
+// to genesis when the chains share nothing else
+func findFork(tx *bolt.Tx, locator [][]byte) *blockNode {
+	for _, hash := range locator {
+		node := getBlockNode(tx, hash)
+		if node != nil && inMainChain(tx, node) {
+			return node
+		}
+	}
+	return getBlockNode(tx, mainChainHash(tx, 0))
+}
+
+// indexMainChain fills the main chain index from the tip back, for
+// databases created before the index existed
+func indexMainChain(tx *bolt.Tx) {
+	b := tx.Bucket([]byte(mainChainBucket))
+	for node := tipNode(tx); node != nil; node = getBlockNode(tx, node.PreBlockHash) {
+		err := b.Put(heightKey(node.Height), node.Hash)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if len(node.PreBlockHash) == 0 {
+			break
+		}
+	}
+}
+
+// indexBlocks adds an index entry for every stored block that lacks one,
+// which upgrades databases created before the block index existed
+func indexBlocks(tx *bolt.Tx) {
+	blocks := tx.Bucket([]byte(blockBucket))
+
+	var index func(hash []byte) *blockNode
+	index = func(hash []byte) *blockNode {
+		node := getBlockNode(tx, hash)
+		if node != nil {
+			return node
+		}
+		block := DeSerializeBlock(blocks.Get(hash))
+		var parent *blockNode
+		if len(block.PreBlockHash) > 0 {
+			parent = index(block.PreBlockHash)
+		}
+		node = newBlockNode(block, parent)
+		putBlockNode(tx, node)
+		return node
+	}
+
+	c := blocks.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if bytes.Equal(k, []byte("l")) {
+			continue
+		}
+		index(k)
+	}
+}
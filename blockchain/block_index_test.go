@@ -0,0 +1,182 @@
+package blockchain
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHash(branch byte, height int) []byte {
+	return []byte{branch, byte(height >> 8), byte(height)}
+}
+
+// buildTestIndex indexes a 100 block main chain and a side branch that
+// forks off after block 90
+func buildTestIndex(t *testing.T, tx *bolt.Tx) *blockNode {
+	for _, name := range []string{blockIndexBucket, mainChainBucket} {
+		_, err := tx.CreateBucket([]byte(name))
+		assert.NoError(t, err)
+	}
+
+	var preHash []byte
+	for height := 0; height < 100; height++ {
+		node := &blockNode{Hash: testHash('m', height), PreBlockHash: preHash, Height: height, ChainWork: big.NewInt(int64(height))}
+		putBlockNode(tx, node)
+		assert.NoError(t, tx.Bucket([]byte(mainChainBucket)).Put(heightKey(height), node.Hash))
+		preHash = node.Hash
+	}
+
+	var side *blockNode
+	preHash = testHash('m', 90)
+	for height := 91; height < 120; height++ {
+		side = &blockNode{Hash: testHash('s', height), PreBlockHash: preHash, Height: height, ChainWork: big.NewInt(int64(height)), HeaderOnly: true}
+		putBlockNode(tx, side)
+		preHash = side.Hash
+	}
+	return side
+}
+
+func TestBlockLocator(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "index.db"), 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		side := buildTestIndex(t, tx)
+
+		locator := blockLocator(tx, getBlockNode(tx, testHash('m', 99)))
+		var heights []int
+		for _, hash := range locator {
+			heights = append(heights, getBlockNode(tx, hash).Height)
+		}
+		assert.Equal(t, []int{99, 98, 97, 96, 95, 94, 93, 92, 91, 90, 88, 84, 76, 60, 28, 0}, heights)
+
+		locator = blockLocator(tx, side)
+		assert.Equal(t, testHash('s', 119), locator[0], "locator starts at the side branch tip")
+		assert.Equal(t, testHash('m', 0), locator[len(locator)-1], "locator ends at genesis")
+
+		// the locator is sparse by then, so the fork found is the latest
+		// main chain entry in it rather than block 90 itself
+		fork := findFork(tx, locator)
+		assert.Equal(t, 80, fork.Height)
+		assert.Equal(t, testHash('m', 80), fork.Hash)
+
+		fork = findFork(tx, [][]byte{[]byte("unknown")})
+		assert.Equal(t, 0, fork.Height, "unknown locators fall back to genesis")
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestLocateBlocks(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "index.db"), 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var locator [][]byte
+	err = db.Update(func(tx *bolt.Tx) error {
+		locator = blockLocator(tx, buildTestIndex(t, tx))
+		return nil
+	})
+	assert.NoError(t, err)
+	bc := &BlockChain{Db: db}
+
+	hashes := bc.LocateBlocks(locator, nil, 500)
+	assert.Len(t, hashes, 19, "every main chain block after the fork at 80")
+	assert.Equal(t, testHash('m', 81), hashes[0])
+	assert.Equal(t, testHash('m', 99), hashes[18])
+
+	hashes = bc.LocateBlocks(locator, testHash('m', 85), 500)
+	assert.Equal(t, [][]byte{testHash('m', 81), testHash('m', 82), testHash('m', 83), testHash('m', 84), testHash('m', 85)}, hashes)
+
+	hashes = bc.LocateBlocks(locator, nil, 3)
+	assert.Len(t, hashes, 3, "batch limit")
+
+	hashes = bc.LocateBlocks([][]byte{testHash('m', 99)}, nil, 500)
+	assert.Empty(t, hashes, "nothing after our tip")
+}
+
+func TestLocateHeaders(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis := bc.Tip()
+	fundOutputs(t, bc, wallet, 1)
+	tip, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+
+	headers, err := bc.LocateHeaders([][]byte{genesis}, nil, maxHeadersPerMsg)
+	assert.NoError(t, err)
+	assert.Equal(t, []BlockHeader{*tip.Header()}, headers)
+
+	// a block missing from the store is an error, not a panic
+	err = bc.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blockBucket)).Delete(tip.Hash)
+	})
+	assert.NoError(t, err)
+	_, err = bc.LocateHeaders([][]byte{genesis}, nil, maxHeadersPerMsg)
+	assert.Error(t, err)
+}
+
+func TestCalcPastMedianTime(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "index.db"), 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	tests := []struct {
+		timestamps []int64
+		median     int64
+	}{
+		{[]int64{100}, 100},
+		{[]int64{100, 300, 200}, 200},
+		{[]int64{100, 200, 300, 400}, 300},
+		// only the last medianTimeBlocks count
+		{[]int64{1, 1, 1, 1, 1, 1, 50, 40, 30, 20, 10, 60, 70, 80, 90, 100}, 50},
+	}
+	for i, test := range tests {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(blockIndexBucket))
+			assert.NoError(t, err)
+			var node *blockNode
+			for height, timestamp := range test.timestamps {
+				next := &blockNode{Hash: testHash(byte(i), height), Height: height, Timestamp: timestamp}
+				if node != nil {
+					next.PreBlockHash = node.Hash
+				}
+				putBlockNode(tx, next)
+				node = next
+			}
+			assert.Equal(t, test.median, calcPastMedianTime(tx, node), "timestamps %v", test.timestamps)
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+}
+
+func TestBetterThan(t *testing.T) {
+	tests := []struct {
+		work, otherWork int64
+		hash, otherHash []byte
+		better          bool
+	}{
+		{2, 1, []byte{9}, []byte{1}, true},
+		{1, 2, []byte{1}, []byte{9}, false},
+		// equal work is decided by the lower hash
+		{1, 1, []byte{1}, []byte{9}, true},
+		{1, 1, []byte{9}, []byte{1}, false},
+		{1, 1, []byte{1}, []byte{1}, false},
+	}
+	for _, test := range tests {
+		n := &blockNode{Hash: test.hash, ChainWork: big.NewInt(test.work)}
+		other := &blockNode{Hash: test.otherHash, ChainWork: big.NewInt(test.otherWork)}
+		assert.Equal(t, test.better, n.betterThan(other), "%+v", test)
+	}
+
+	header := &BlockHeader{Height: 1, Bits: activeNetParams.PowLimitBits}
+	parent := &blockNode{ChainWork: big.NewInt(1000)}
+	node := newHeaderNode(header, parent)
+	expected := new(big.Int).Add(NewHeaderProofOfWork(header).Work(), parent.ChainWork)
+	assert.Equal(t, 0, expected.Cmp(node.ChainWork), "chain work adds up along the branch")
+	assert.True(t, node.HeaderOnly)
+}
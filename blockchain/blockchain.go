@@ -11,98 +11,125 @@ import (
 	"os"
 )
 
+// BlockChain is the block store. The main chain tip is the "l" key of the
+// blocks bucket and is only read inside a bolt transaction, since AddBlock
+// moves it from whichever goroutine received the block.
 type BlockChain struct {
-	tip []byte
-	Db  *bolt.DB
+	Db *bolt.DB
 }
 
 const dbFile = "blockchain_%s.db"
 const blockBucket = "blocks"
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
-// MineBLock mines a block with the provided transactions
-func (bc *BlockChain) MineBLock(transactions []*Transaction) *Block {
+// MineBLock mines a block with the provided transactions and adds it. They
+// are validated when the block is added, which lets them spend each other's
+// outputs. The error is AddBlock's, for instance when the tip moved while
+// the block was mined.
+func (bc *BlockChain) MineBLock(transactions []*Transaction) (*Block, *ChainUpdate, error) {
 	var lastHash []byte
 	var lastHeight int
-
-	for _, tx := range transactions {
-		if !bc.VerifyTransaction(tx) {
-			log.Panicln("ERROR: invalid transaction")
-		}
-	}
+	var bits uint32
+	var timestamp int64
 
 	err := bc.Db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(blockBucket))
-		lastHash = bucket.Get([]byte("l"))
-		lastHeight = DeSerializeBlock(bucket.Get(lastHash)).Height
-		return nil
-	})
-	if err != nil {
-		log.Panicln(err)
-	}
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
-	err = bc.Db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(blockBucket))
-		err := bucket.Put(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			log.Panicln(err)
+		lastHash = append([]byte{}, bucket.Get([]byte("l"))...)
+		lastNode := getBlockNode(tx, lastHash)
+		lastHeight = lastNode.Height
+		bits = calcNextBits(tx, lastNode)
+		timestamp = timeSource.AdjustedTime()
+		if medianTime := calcPastMedianTime(tx, lastNode); timestamp <= medianTime {
+			timestamp = medianTime + 1
 		}
-		err = bucket.Put([]byte("l"), newBlock.Hash)
-		if err != nil {
-			log.Panicln(err)
-		}
-		bc.tip = newBlock.Hash
 		return nil
 	})
 	if err != nil {
 		log.Panicln(err)
 	}
-	return newBlock
+	newBlock := NewBlock(transactions, lastHash, lastHeight+1, bits, timestamp)
+	update, err := bc.AddBlock(newBlock)
+	return newBlock, update, err
 }
 
-func (bc *BlockChain) AddBlock(block *Block) {
+// AddBlock checks a block received from a peer and stores it. When the block
+// ends a chain with more cumulative work than the current one the chain is
+// reorganized onto it, all inside one bolt transaction. Inputs are only
+// verified when a block is connected, so a side-branch block is stored
+// after its context checks and fully validated if its branch ever becomes
+// the main chain. Rejected blocks are not stored and the returned error is
+// a *BlockRejectError. A block that fails to connect is marked invalid in
+// the block index along with its descendants.
+func (bc *BlockChain) AddBlock(block *Block) (*ChainUpdate, error) {
+	update := &ChainUpdate{}
+	// failed is the block a reorganization could not connect
+	var failed *blockNode
 	err := bc.Db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blockBucket))
 		blockInDb := b.Get(block.Hash)
 		if blockInDb != nil {
 			return nil
 		}
+		if node := getBlockNode(tx, block.Hash); node != nil && node.Invalid {
+			return rejectBlock(block, ErrInvalidChain, "")
+		}
+
+		err := checkBlockContext(tx, block)
+		if err != nil {
+			return err
+		}
 
 		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		err = b.Put(block.Hash, blockData)
 		if err != nil {
 			log.Panicln(err)
 		}
+		node := newBlockNode(block, getBlockNode(tx, block.PreBlockHash))
+		putBlockNode(tx, node)
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeSerializeBlock(lastBlockData)
-		if block.Height > lastBlock.Height {
-			err := b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panicln(err)
+		bestNode := getBlockNode(tx, b.Get([]byte("l")))
+		if node.betterThan(bestNode) {
+			update, err = reorganize(tx, block)
+			var rejectErr *BlockRejectError
+			if errors.As(err, &rejectErr) {
+				failed = getBlockNode(tx, rejectErr.Hash)
 			}
-			bc.tip = block.Hash
+			return err
 		}
 		return nil
 	})
+	if failed != nil {
+		// the rollback dropped everything, including the new block, so the
+		// failure is recorded on its own
+		dbErr := bc.Db.Update(func(tx *bolt.Tx) error {
+			markInvalid(tx, failed)
+			return nil
+		})
+		if dbErr != nil {
+			log.Panicln(dbErr)
+		}
+	}
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
 	}
+	return update, nil
 }
 
 func (bc *BlockChain) GetBestHeight() int {
-	var lastBlock Block
+	return bc.bestNode().Height
+}
+
+// bestNode returns the block index entry of the current tip
+func (bc *BlockChain) bestNode() *blockNode {
+	var node *blockNode
 	err := bc.Db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(blockBucket))
-		lastHash := bucket.Get([]byte("l"))
-		lastBlock = *DeSerializeBlock(bucket.Get(lastHash))
+		node = tipNode(tx)
 		return nil
 	})
 	if err != nil {
 		log.Panicln(err)
 	}
-	return lastBlock.Height
+	return node
 }
 
 func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
@@ -123,18 +150,70 @@ func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-func (bc *BlockChain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
-	bci := bc.Iterator()
+// BlockLocator describes the main chain to a peer, see blockLocator
+func (bc *BlockChain) BlockLocator() [][]byte {
+	var locator [][]byte
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		locator = blockLocator(tx, tipNode(tx))
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	return locator
+}
 
-	for {
-		block := bci.Next()
-		blocks = append(blocks, block.Hash)
-		if len(block.PreBlockHash) == 0 {
+// LocateBlocks returns the hashes of the main chain blocks after the fork
+// point of locator, oldest first. It stops after hashStop or max hashes.
+func (bc *BlockChain) LocateBlocks(locator [][]byte, hashStop []byte, max int) [][]byte {
+	var hashes [][]byte
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		hashes = locateBlocks(tx, locator, hashStop, max)
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	return hashes
+}
+
+// LocateHeaders returns the headers of the blocks LocateBlocks finds. They
+// are read in the same bolt transaction as the hashes, so a concurrent
+// reorganization cannot pull a block out from under the answer.
+func (bc *BlockChain) LocateHeaders(locator [][]byte, hashStop []byte, max int) ([]BlockHeader, error) {
+	var headers []BlockHeader
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blockBucket))
+		for _, hash := range locateBlocks(tx, locator, hashStop, max) {
+			blockData := blocks.Get(hash)
+			if blockData == nil {
+				return fmt.Errorf("main chain block %x is not stored", hash)
+			}
+			headers = append(headers, *DeSerializeBlock(blockData).Header())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+func locateBlocks(tx *bolt.Tx, locator [][]byte, hashStop []byte, max int) [][]byte {
+	var hashes [][]byte
+	fork := findFork(tx, locator)
+	for height := fork.Height + 1; len(hashes) < max; height++ {
+		hash := mainChainHash(tx, height)
+		if hash == nil {
+			break
+		}
+		// bolt owns hash only until the transaction ends
+		hashes = append(hashes, append([]byte{}, hash...))
+		if bytes.Equal(hash, hashStop) {
 			break
 		}
 	}
-	return blocks
+	return hashes
 }
 
 func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
@@ -150,45 +229,6 @@ func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 	tx.Sign(privKey, preTXs)
 }
 
-// FindUTXO finds and return unspent transactions outputs
-func (bc *BlockChain) FindUTXO() map[string]TXOutputs {
-	UTXO := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
-			}
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Vin {
-					inTxID := hex.EncodeToString(in.Txid)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-				}
-			}
-		}
-
-		if len(block.PreBlockHash) == 0 {
-			break
-		}
-	}
-	return UTXO
-}
-
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 	iterator := bc.Iterator()
 	for {
@@ -205,23 +245,21 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("transaction is not found")
 }
 
-func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
-	}
-	prevTXs := make(map[string]Transaction)
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			log.Panicln(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+// Tip returns the hash of the main chain tip
+func (bc *BlockChain) Tip() []byte {
+	var tip []byte
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		tip = append([]byte{}, tx.Bucket([]byte(blockBucket)).Get([]byte("l"))...)
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
 	}
-	return tx.Verify(prevTXs)
+	return tip
 }
 
 func (bc *BlockChain) Iterator() *BlockchainIterator {
-	return &BlockchainIterator{bc.tip, bc.Db}
+	return &BlockchainIterator{bc.Tip(), bc.Db}
 }
 
 func dbExists(dbFile string) bool {
@@ -237,20 +275,28 @@ func NewBlockChain(nodeID string) *BlockChain {
 		log.Println("No existing blockchain found. Create one first.")
 		os.Exit(1)
 	}
-	var tip []byte
 	db, err := bolt.Open(dbFile, os.ModePerm, nil)
 	if err != nil {
 		log.Panicln("err:", err)
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blockBucket))
-		tip = b.Get([]byte("l"))
+		newMainChainIndex := tx.Bucket([]byte(mainChainBucket)) == nil
+		for _, bucketName := range []string{utxoBucket, undoBucket, blockIndexBucket, mainChainBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		indexBlocks(tx)
+		if newMainChainIndex {
+			indexMainChain(tx)
+		}
 		return nil
 	})
 	if err != nil {
 		log.Panicln("Db update err:", err)
 	}
-	return &BlockChain{tip, db}
+	return &BlockChain{db}
 }
 
 func CreateBlockchain(address string, nodeID string) *BlockChain {
@@ -259,8 +305,7 @@ func CreateBlockchain(address string, nodeID string) *BlockChain {
 		log.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
-	var tip []byte
-	cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
+	cbtx := NewCoinbaseTX(address, genesisCoinbaseData, 0, 0)
 	block := NewGenesisBlock(cbtx)
 
 	db, err := bolt.Open(dbFile, os.ModePerm, nil)
@@ -280,14 +325,17 @@ func CreateBlockchain(address string, nodeID string) *BlockChain {
 		if err != nil {
 			log.Panicln(err)
 		}
-		tip = block.Hash
+		_, err = tx.CreateBucket([]byte(blockIndexBucket))
+		if err != nil {
+			log.Panicln(err)
+		}
+		putBlockNode(tx, newBlockNode(block, nil))
 		return nil
 	})
 	if err != nil {
 		log.Panicln(err)
 	}
 	return &BlockChain{
-		tip: tip,
-		Db:  db,
+		Db: db,
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
 )
 
 type CLI struct {
@@ -19,13 +20,22 @@ func (cli *CLI) validArgs() {
 func (cli *CLI) printUsage() {
 	log.Println("Usage:")
 	log.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
+	log.Println("  clearbans -host HOST - Lift the ban of HOST, or HOST:PORT for a local node, or every ban when -host is omitted")
 	log.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
 	log.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	log.Println("  getsupply - Report the circulating supply from the UTXO set")
 	log.Println("  listaddresses - Lists all addresses from the wallet file")
+	log.Println("  listbans - List the banned peer addresses")
+	log.Println("  nodekey - Print the public key the node is identified by on encrypted connections")
 	log.Println("  printchain - Print all the blocks of the blockchain")
 	log.Println("  reindexutxo - Rebuilds the UTXO set")
-	log.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO")
-	log.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. -miner enables mining")
+	log.Println("  send -from FROM -to TO -amount AMOUNT -fee FEE -mine -rbf - Send AMOUNT of coins from FROM address to TO, paying FEE to the miner. -rbf lets bumpfee replace the transaction")
+	log.Println("  bumpfee -txid TXID -fee FEE - Replace a pending -rbf transaction with one paying FEE in total, taken from its change")
+	log.Println("  startnode -miner ADDRESS -bantime DURATION -listen HOST:PORT -advertise HOST:PORT - Start a node with ID specified in NODE_ID env. -miner enables mining, -bantime sets how long misbehaving peers are banned, -listen sets the address to bind to (default localhost:NODE_ID), -advertise the address peers are told to connect to (default the -listen address)")
+	log.Println("  startnode -allowkeys FILE - Only connect with peers whose node key is listed in FILE, one hex key per line, needs TRANSPORT=noise")
+	log.Println("Set NETWORK env to mainnet (default) or testnet to choose the consensus parameters")
+	log.Println("Set SEEDS env to a comma-separated list of node addresses to connect to first")
+	log.Println("Set TRANSPORT env to plain (default) or noise to encrypt and authenticate connections, every node of a network has to use the same")
 }
 
 func (cli *CLI) Run() {
@@ -35,12 +45,35 @@ func (cli *CLI) Run() {
 	if nodeID == "" {
 		log.Panicln("NODE_ID env is not set")
 	}
+	if network := os.Getenv("NETWORK"); network != "" {
+		params, ok := netParamsByName(network)
+		if !ok {
+			log.Panicln("unknown NETWORK:", network)
+		}
+		activeNetParams = params
+	}
+	seedNodes = activeNetParams.DefaultSeeds
+	if seeds := os.Getenv("SEEDS"); seeds != "" {
+		seedNodes = strings.Split(seeds, ",")
+	}
+	switch transport := os.Getenv("TRANSPORT"); transport {
+	case "", "plain":
+	case "noise":
+		transportKey = loadNodeKey(nodeID)
+	default:
+		log.Panicln("unknown TRANSPORT:", transport)
+	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	listBansCmd := flag.NewFlagSet("listbans", flag.ExitOnError)
+	nodeKeyCmd := flag.NewFlagSet("nodekey", flag.ExitOnError)
+	clearBansCmd := flag.NewFlagSet("clearbans", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
@@ -50,8 +83,17 @@ func (cli *CLI) Run() {
 	sendTo := sendCmd.String("to", "", "destination wallet address")
 	sendFrom := sendCmd.String("from", "", "source wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee to pay the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendReplaceable := sendCmd.Bool("rbf", false, "Allow replacing the transaction with one paying a higher fee")
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "ID of the pending transaction")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New total fee to pay the miner")
 	startNodeMiner := startNodeCmd.String("miner", "", "")
+	startNodeBanTime := startNodeCmd.Duration("bantime", defaultBanDuration, "how long misbehaving peers are banned")
+	startNodeListen := startNodeCmd.String("listen", "", "the address to accept connections on, localhost:NODE_ID when empty")
+	startNodeAdvertise := startNodeCmd.String("advertise", "", "the address peers should connect to, the listen address when empty")
+	startNodeAllowKeys := startNodeCmd.String("allowkeys", "", "file listing the node keys allowed to connect, any key when empty")
+	clearBansHost := clearBansCmd.String("host", "", "the host to lift the ban of, every host when empty")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -59,6 +101,11 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panicln(err)
 		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panicln(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -74,6 +121,21 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panicln(err)
 		}
+	case "listbans":
+		err := listBansCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panicln(err)
+		}
+	case "clearbans":
+		err := clearBansCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panicln(err)
+		}
+	case "nodekey":
+		err := nodeKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panicln(err)
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -89,6 +151,11 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panicln(err)
 		}
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panicln(err)
+		}
 	case "startnode":
 		err := startNodeCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -107,6 +174,10 @@ func (cli *CLI) Run() {
 		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
+	if getSupplyCmd.Parsed() {
+		cli.getSupply(nodeID)
+	}
+
 	if createBlockchainCmd.Parsed() {
 		if *createBlockchainAddress == "" {
 			createBlockchainCmd.Usage()
@@ -132,11 +203,31 @@ func (cli *CLI) Run() {
 	}
 
 	if sendCmd.Parsed() {
-		if *sendTo == "" || *sendFrom == "" || *sendAmount <= 0 {
+		if *sendTo == "" || *sendFrom == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeID, *sendMine, *sendReplaceable)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeFee <= 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID)
+	}
+
+	if listBansCmd.Parsed() {
+		cli.listBans(nodeID)
+	}
+
+	if clearBansCmd.Parsed() {
+		cli.clearBans(*clearBansHost, nodeID)
+	}
+
+	if nodeKeyCmd.Parsed() {
+		cli.nodeKey(nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -145,6 +236,21 @@ func (cli *CLI) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		banDuration = *startNodeBanTime
+		if *startNodeAllowKeys != "" {
+			if transportKey == nil {
+				log.Panicln("-allowkeys needs TRANSPORT=noise")
+			}
+			allowedKeys = loadAllowedKeys(*startNodeAllowKeys)
+		}
+		listenAddr := *startNodeListen
+		if listenAddr == "" {
+			listenAddr = defaultListenAddr(nodeID)
+		}
+		advertisedAddr := *startNodeAdvertise
+		if advertisedAddr == "" {
+			advertisedAddr = defaultAdvertisedAddr(listenAddr)
+		}
+		cli.startNode(nodeID, listenAddr, advertisedAddr, *startNodeMiner)
 	}
 }
@@ -0,0 +1,27 @@
+package blockchain
+
+import (
+	"log"
+	"time"
+)
+
+func (cli *CLI) listBans(nodeID string) {
+	bc := NewBlockChain(nodeID)
+	defer bc.Db.Close()
+
+	bans := loadBans(bc.Db)
+	if len(bans) == 0 {
+		log.Println("No banned addresses")
+		return
+	}
+	for _, ban := range bans {
+		log.Printf("%s banned until %s: %s\n", ban.Host, time.Unix(ban.Until, 0).Format(time.RFC3339), ban.Reason)
+	}
+}
+
+func (cli *CLI) clearBans(host, nodeID string) {
+	bc := NewBlockChain(nodeID)
+	defer bc.Db.Close()
+
+	log.Printf("Lifted %d bans\n", deleteBans(bc.Db, host))
+}
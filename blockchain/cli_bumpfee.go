@@ -0,0 +1,43 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"log"
+)
+
+func (cli *CLI) bumpFee(txID string, fee int, nodeID string) {
+	bc := NewBlockChain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.Db.Close()
+
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panicln(err)
+	}
+	pending, ok := wallets.Pending[txID]
+	if !ok {
+		log.Panicln("ERROR: no pending transaction", txID)
+	}
+	wallet, ok := wallets.Wallets[pending.From]
+	if !ok {
+		log.Panicln("ERROR: the wallet does not hold the key of", pending.From)
+	}
+
+	bumped, err := NewBumpedTransaction(wallet, pending.Tx, pending.Change, fee, &UTXOSet)
+	if err != nil {
+		log.Panicln("ERROR:", err)
+	}
+	err = submitTx(pending.Node, bumped)
+	if err != nil {
+		log.Panicln(err)
+	}
+	change := pending.Change
+	if len(bumped.Vout) < len(pending.Tx.Vout) {
+		// the fee took all of the change
+		change = -1
+	}
+	delete(wallets.Pending, txID)
+	wallets.Pending[hex.EncodeToString(bumped.ID)] = &PendingTx{bumped, pending.From, change, pending.Node}
+	wallets.SaveToFile(nodeID)
+	log.Printf("Replaced %s with %x\n", txID, bumped.ID)
+}
@@ -11,13 +11,12 @@ func (cli *CLI) getBalance(address, nodeID string) {
 	defer bc.Db.Close()
 	UTXOSet := UTXOSet{bc}
 
-	balance := 0
 	pubKeyHash := Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	balance, immature := UTXOSet.FindBalance(pubKeyHash)
 
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
 	log.Printf("Balance of '%s' is : '%d'", address, balance)
+	if immature > 0 {
+		log.Printf("Immature coinbase rewards of '%s': '%d'", address, immature)
+	}
 }
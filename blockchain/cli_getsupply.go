@@ -0,0 +1,12 @@
+package blockchain
+
+import "log"
+
+func (cli *CLI) getSupply(nodeID string) {
+	bc := NewBlockChain(nodeID)
+	defer bc.Db.Close()
+	UTXOSet := UTXOSet{bc}
+
+	log.Printf("Circulating supply at height %d: %d\n", bc.GetBestHeight(), UTXOSet.CirculatingSupply())
+	log.Printf("Maximum supply: %d\n", CalcMaxSupply())
+}
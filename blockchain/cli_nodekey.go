@@ -0,0 +1,10 @@
+package blockchain
+
+import "log"
+
+// nodeKey prints the public static key of the node, for the allow-lists of
+// other nodes
+func (cli *CLI) nodeKey(nodeID string) {
+	key := loadNodeKey(nodeID)
+	log.Printf("%x\n", key.PublicKey().Bytes())
+}
@@ -14,6 +14,7 @@ func (cli *CLI) printChain(nodeID string) {
 		log.Printf("============= Block %x =============\n", block.Hash)
 		log.Printf("Height: %x\n", block.Height)
 		log.Printf("Prev. block.hash: %x\n", block.PreBlockHash)
+		log.Printf("Bits: %08x\n", block.Bits)
 		pow := NewProofOfWork(block)
 		log.Println("Pow: ", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
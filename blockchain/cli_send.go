@@ -1,8 +1,11 @@
 package blockchain
 
-import "log"
+import (
+	"encoding/hex"
+	"log"
+)
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CLI) send(from, to string, amount, fee int, nodeID string, mineNow, replaceable bool) {
 	if !ValidateAddress(from) {
 		log.Panicln("ERROR: sender address is not valid")
 	}
@@ -19,14 +22,29 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 		log.Panicln(err)
 	}
 	wallet := wallets.GetWallet(from)
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx := NewUTXOTransaction(&wallet, to, amount, fee, replaceable, &UTXOSet)
 
 	if mineNow {
-		coinbaseTX := NewCoinbaseTX(from, "")
-		newBlock := bc.MineBLock([]*Transaction{tx, coinbaseTX})
-		UTXOSet.Update(newBlock)
+		coinbaseTX := NewCoinbaseTX(from, "", bc.GetBestHeight()+1, fee)
+		_, _, err = bc.MineBLock([]*Transaction{tx, coinbaseTX})
+		if err != nil {
+			log.Panicln(err)
+		}
 	} else {
-		sendTx(knownNodes[0], tx)
+		node := seedNodes[0]
+		err = submitTx(node, tx)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if replaceable {
+			change := -1
+			if len(tx.Vout) > changeOutput {
+				change = changeOutput
+			}
+			wallets.Pending[hex.EncodeToString(tx.ID)] = &PendingTx{tx, from, change, node}
+			wallets.SaveToFile(nodeID)
+			log.Printf("Transaction %x can be replaced with bumpfee until it confirms\n", tx.ID)
+		}
 	}
 	log.Println("Success!")
 }
@@ -2,7 +2,7 @@ package blockchain
 
 import "log"
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, listenAddr, advertisedAddr, minerAddress string) {
 	log.Println("Start Node node:", nodeID)
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
@@ -11,5 +11,5 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panicln("wrong miner address")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	StartServer(nodeID, listenAddr, advertisedAddr, minerAddress)
 }
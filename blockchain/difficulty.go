@@ -0,0 +1,101 @@
+package blockchain
+
+import (
+	"github.com/boltdb/bolt"
+	"math/big"
+	"time"
+)
+
+// CompactToBig expands a compact difficulty, as stored in Block.Bits, into
+// the full target. The top byte is a base-256 exponent and the low 23 bits
+// are the mantissa; bit 23 is a sign bit.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if isNegative {
+		target.Neg(target)
+	}
+	return target
+}
+
+// BigToCompact is the inverse of CompactToBig, dropping any precision that
+// does not fit in the mantissa
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(target).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		shifted := new(big.Int).Abs(target)
+		mantissa = uint32(shifted.Rsh(shifted, 8*(exponent-3)).Uint64())
+	}
+
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// retarget scales the target of oldBits by how long the last retarget
+// interval actually took against how long it should have taken
+func retarget(params *NetParams, oldBits uint32, actualTimespan, expectedTimespan int64) uint32 {
+	minTimespan := expectedTimespan / params.MaxRetargetFactor
+	maxTimespan := expectedTimespan * params.MaxRetargetFactor
+	if actualTimespan < minTimespan {
+		actualTimespan = minTimespan
+	} else if actualTimespan > maxTimespan {
+		actualTimespan = maxTimespan
+	}
+
+	target := CompactToBig(oldBits)
+	target.Mul(target, big.NewInt(actualTimespan))
+	target.Div(target, big.NewInt(expectedTimespan))
+
+	powLimit := CompactToBig(params.PowLimitBits)
+	if target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+	return BigToCompact(target)
+}
+
+// calcNextBits returns the difficulty the block after parent must carry.
+// The target only changes every RetargetInterval blocks.
+func calcNextBits(tx *bolt.Tx, parent *blockNode) uint32 {
+	params := activeNetParams
+	if (parent.Height+1)%params.RetargetInterval != 0 {
+		return parent.Bits
+	}
+
+	first := parent
+	for i := 0; i < params.RetargetInterval && len(first.PreBlockHash) > 0; i++ {
+		first = getBlockNode(tx, first.PreBlockHash)
+	}
+	blocks := int64(parent.Height - first.Height)
+	if blocks == 0 {
+		return parent.Bits
+	}
+
+	actualTimespan := parent.Timestamp - first.Timestamp
+	expectedTimespan := blocks * int64(params.TargetBlockInterval/time.Second)
+	return retarget(params, parent.Bits, actualTimespan, expectedTimespan)
+}
@@ -0,0 +1,35 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	target := new(big.Int).Lsh(big.NewInt(1), 240)
+	assert.Equal(t, uint32(0x1f010000), BigToCompact(target), "2^240 packs to 0x1f010000")
+	assert.Equal(t, 0, target.Cmp(CompactToBig(0x1f010000)), "0x1f010000 expands to 2^240")
+
+	for _, bits := range []uint32{0x1d00ffff, 0x1f100000, 0x03123456, 0x207fffff} {
+		assert.Equal(t, bits, BigToCompact(CompactToBig(bits)), "compact %08x round trips", bits)
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	params := &TestNetParams
+	bits := uint32(0x1e100000)
+	expected := int64(100)
+
+	assert.Equal(t, bits, retarget(params, bits, expected, expected), "on schedule keeps the target")
+
+	harder := CompactToBig(retarget(params, bits, expected/2, expected))
+	assert.Equal(t, 0, harder.Cmp(new(big.Int).Rsh(CompactToBig(bits), 1)), "blocks twice as fast halve the target")
+
+	clamped := CompactToBig(retarget(params, bits, 1, expected))
+	assert.Equal(t, 0, clamped.Cmp(new(big.Int).Rsh(CompactToBig(bits), 2)), "adjustment is clamped to the max factor")
+
+	easiest := retarget(params, params.PowLimitBits, expected*10, expected)
+	assert.Equal(t, params.PowLimitBits, easiest, "target never exceeds the pow limit")
+}
@@ -0,0 +1,763 @@
+package blockchain
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Fee rates are fees per 1000 bytes of serialized transaction.
+const (
+	// defaultMaxMempoolBlocks is how many full blocks worth of transactions
+	// the mempool holds at most
+	defaultMaxMempoolBlocks = 20
+	// minRelayFeeRate is the fee rate a transaction must pay to enter a
+	// mempool that has not evicted anything
+	minRelayFeeRate = 0
+	// incrementalFeeRate is added to the fee rate of evicted transactions
+	// to get the minimum the mempool accepts afterwards
+	incrementalFeeRate = 1
+	// the minimum fee rate raised by evictions halves every
+	// minFeeRateHalfLife, so it returns to minRelayFeeRate once the mempool
+	// is no longer full
+	minFeeRateHalfLife = 12 * time.Hour
+	// maxReplacementEvictions bounds the entries one replacement may evict,
+	// descendants included
+	maxReplacementEvictions = 100
+)
+
+var (
+	ErrTxInMempool       = errors.New("transaction is already in the mempool")
+	ErrCoinbaseInMempool = errors.New("coinbase transactions are only valid in blocks")
+	ErrMempoolConflict   = errors.New("input is already spent by a mempool transaction")
+	ErrDuplicateInput    = errors.New("transaction spends an output twice")
+	ErrTxTooBig          = errors.New("transaction is too big to fit in a block")
+	ErrMempoolFull       = errors.New("mempool is full")
+	ErrInsufficientFee   = errors.New("fee rate is below the mempool minimum")
+	ErrReplacementFee    = errors.New("replacement does not pay more than the transactions it replaces")
+	ErrTooManyEvictions  = errors.New("replacement would evict too many transactions")
+	ErrReplacementInputs = errors.New("replacement spends unconfirmed outputs the replaced transactions did not")
+)
+
+// TxRejectError is returned when a transaction is not accepted to the
+// mempool. Reason is one of the Err* values so callers can match it with
+// errors.Is.
+type TxRejectError struct {
+	ID     []byte
+	Reason error
+	Detail string
+}
+
+func (e *TxRejectError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("transaction %x rejected: %v", e.ID, e.Reason)
+	}
+	return fmt.Sprintf("transaction %x rejected: %v: %s", e.ID, e.Reason, e.Detail)
+}
+
+func (e *TxRejectError) Unwrap() error {
+	return e.Reason
+}
+
+func rejectTx(tx *Transaction, reason error, format string, args ...interface{}) error {
+	return &TxRejectError{
+		ID:     tx.ID,
+		Reason: reason,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+// txIsPunishable reports whether a peer relaying a transaction rejected for
+// err broke the rules. Missing inputs, conflicts and a full mempool can
+// happen to honest peers whose view of the chain differs from ours.
+func txIsPunishable(err *TxRejectError) bool {
+	switch err.Reason {
+	case ErrTxInMempool, ErrMissingInput, ErrOrphanTransaction, ErrImmatureSpend, ErrMempoolConflict, ErrTxTooBig, ErrMempoolFull, ErrInsufficientFee,
+		ErrReplacementFee, ErrTooManyEvictions, ErrReplacementInputs:
+		return false
+	}
+	return true
+}
+
+func outpointKey(txID []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txID, vout)
+}
+
+func feeRate(fee, size int) float64 {
+	return float64(fee) * 1000 / float64(size)
+}
+
+type mempoolEntry struct {
+	tx   *Transaction
+	fee  int
+	size int
+	// seq orders entries by admission
+	seq uint64
+	// parents are the entries whose outputs this one spends and children
+	// the entries spending its outputs
+	parents  map[*mempoolEntry]bool
+	children map[*mempoolEntry]bool
+	// the ancestor totals cover the entry and every entry it depends on,
+	// the descendant totals the entry and every entry depending on it
+	ancestorFee    int
+	ancestorSize   int
+	descendantFee  int
+	descendantSize int
+	// evictIndex is the position of the entry in Mempool.evictQueue
+	evictIndex int
+}
+
+// descendantFeeRate is the fee rate of the entry together with everything
+// that would be evicted with it
+func (e *mempoolEntry) descendantFeeRate() float64 {
+	return feeRate(e.descendantFee, e.descendantSize)
+}
+
+// evictionQueue is a heap of entries, the one whose descendant package
+// pays the lowest fee rate first and the newest of equal ones
+type evictionQueue []*mempoolEntry
+
+func (q evictionQueue) Len() int { return len(q) }
+
+func (q evictionQueue) Less(i, j int) bool {
+	ri, rj := q[i].descendantFeeRate(), q[j].descendantFeeRate()
+	if ri != rj {
+		return ri < rj
+	}
+	return q[i].seq > q[j].seq
+}
+
+func (q evictionQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].evictIndex = i
+	q[j].evictIndex = j
+}
+
+func (q *evictionQueue) Push(x interface{}) {
+	entry := x.(*mempoolEntry)
+	entry.evictIndex = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *evictionQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// Mempool holds the valid transactions that are not in the main chain yet.
+// Every entry spends outputs of the chainstate or of other entries, and no
+// two entries spend the same output.
+type Mempool struct {
+	bc       *BlockChain
+	maxBytes int
+
+	mu      sync.RWMutex
+	entries map[string]*mempoolEntry
+	// spends maps each outpoint spent by an entry to that entry
+	spends map[string]*mempoolEntry
+	// evictQueue holds every entry, cheapest descendant package first
+	evictQueue evictionQueue
+	bytes      int
+	nextSeq    uint64
+	// rollingMinFeeRate is the minimum fee rate raised by evictions, as of
+	// minFeeRateUpdated
+	rollingMinFeeRate float64
+	minFeeRateUpdated time.Time
+
+	orphans *orphanPool
+}
+
+func NewMempool(bc *BlockChain) *Mempool {
+	return &Mempool{
+		bc:       bc,
+		maxBytes: defaultMaxMempoolBlocks * activeNetParams.MaxBlockSize,
+		entries:  make(map[string]*mempoolEntry),
+		spends:   make(map[string]*mempoolEntry),
+		orphans:  newOrphanPool(),
+	}
+}
+
+// Add validates tx against the chainstate and the other entries and adds
+// it. A transaction spending the same output as entries that signal
+// replacement replaces them when it pays more, see checkReplacement. The
+// returned error is a *TxRejectError.
+func (mp *Mempool) Add(tx *Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.add(tx)
+}
+
+func (mp *Mempool) add(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return rejectTx(tx, ErrCoinbaseInMempool, "")
+	}
+	if len(tx.Vin) == 0 {
+		return rejectTx(tx, ErrNoInputs, "")
+	}
+	if !bytes.Equal(unsignedHash(tx), tx.ID) {
+		return rejectTx(tx, ErrBadTxID, "")
+	}
+	key := hex.EncodeToString(tx.ID)
+	if _, ok := mp.entries[key]; ok {
+		return rejectTx(tx, ErrTxInMempool, "")
+	}
+	size := len(tx.Serialize())
+	if size > activeNetParams.MaxBlockSize/2 {
+		return rejectTx(tx, ErrTxTooBig, "%d bytes", size)
+	}
+
+	outputValue, ok := sumOutputs(tx)
+	if !ok {
+		return rejectTx(tx, ErrBadOutputValue, "")
+	}
+
+	inputValue := 0
+	prevTXs := make(map[string]Transaction)
+	seen := make(map[string]bool)
+	conflicts := make(map[*mempoolEntry]bool)
+	err := mp.bc.Db.View(func(dbTx *bolt.Tx) error {
+		utxo := dbTx.Bucket([]byte(utxoBucket))
+		spendHeight := tipNode(dbTx).Height + 1
+
+		for _, vin := range tx.Vin {
+			outpoint := outpointKey(vin.Txid, vin.Vout)
+			if seen[outpoint] {
+				return rejectTx(tx, ErrDuplicateInput, "%s", outpoint)
+			}
+			seen[outpoint] = true
+			if spender, ok := mp.spends[outpoint]; ok {
+				if !mp.replaceable(spender) {
+					return rejectTx(tx, ErrMempoolConflict, "%s is spent by %x", outpoint, spender.tx.ID)
+				}
+				conflicts[spender] = true
+			}
+
+			var out TXOutput
+			prevID := hex.EncodeToString(vin.Txid)
+			if parent, ok := mp.entries[prevID]; ok {
+				if vin.Vout < 0 || vin.Vout >= len(parent.tx.Vout) {
+					return rejectTx(tx, ErrMissingInput, "spends %s", outpoint)
+				}
+				out = parent.tx.Vout[vin.Vout]
+			} else {
+				outsBytes := utxo.Get(vin.Txid)
+				if outsBytes == nil {
+					return rejectTx(tx, ErrMissingInput, "spends %s", outpoint)
+				}
+				outs := DeserializeOutputs(outsBytes)
+				var ok bool
+				out, ok = outs.Outputs[vin.Vout]
+				if !ok {
+					return rejectTx(tx, ErrMissingInput, "spends %s", outpoint)
+				}
+				if !outs.IsMature(spendHeight) {
+					return rejectTx(tx, ErrImmatureSpend, "spends %s from height %d", outpoint, outs.Height)
+				}
+			}
+			if !vin.UsesKey(out.PubKeyHash) {
+				return rejectTx(tx, ErrBadSignature, "input key does not own %s", outpoint)
+			}
+			inputValue += out.Value
+			if !validMoney(inputValue) {
+				return rejectTx(tx, ErrBadInputValue, "")
+			}
+
+			prevTX, ok := prevTXs[prevID]
+			if !ok {
+				prevTX = Transaction{ID: vin.Txid}
+			}
+			for len(prevTX.Vout) <= vin.Vout {
+				prevTX.Vout = append(prevTX.Vout, TXOutput{})
+			}
+			prevTX.Vout[vin.Vout] = out
+			prevTXs[prevID] = prevTX
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if outputValue > inputValue {
+		return rejectTx(tx, ErrOutputsExceedInput, "spends %d of %d", outputValue, inputValue)
+	}
+	if !tx.Verify(prevTXs) {
+		return rejectTx(tx, ErrBadSignature, "")
+	}
+	fee := inputValue - outputValue
+	if rate, minRate := feeRate(fee, size), mp.minFeeRate(); rate < minRate {
+		return rejectTx(tx, ErrInsufficientFee, "pays %.2f, the minimum is %.2f", rate, minRate)
+	}
+	if len(conflicts) > 0 {
+		evicted, err := mp.checkReplacement(tx, fee, size, conflicts)
+		if err != nil {
+			return err
+		}
+		for entry := range evicted {
+			log.Printf("Transaction %x replaces %x\n", tx.ID, entry.tx.ID)
+			mp.remove(entry, false)
+		}
+	}
+
+	entry := &mempoolEntry{
+		tx:       tx,
+		fee:      fee,
+		size:     size,
+		seq:      mp.nextSeq,
+		parents:  make(map[*mempoolEntry]bool),
+		children: make(map[*mempoolEntry]bool),
+	}
+	mp.nextSeq++
+	for _, vin := range tx.Vin {
+		if parent, ok := mp.entries[hex.EncodeToString(vin.Txid)]; ok {
+			entry.parents[parent] = true
+			parent.children[entry] = true
+		}
+	}
+	// a transaction returning from a disconnected block may already have
+	// children in the pool
+	for i := range tx.Vout {
+		if child, ok := mp.spends[outpointKey(tx.ID, i)]; ok {
+			entry.children[child] = true
+			child.parents[entry] = true
+		}
+	}
+	mp.entries[key] = entry
+	for _, vin := range tx.Vin {
+		mp.spends[outpointKey(vin.Txid, vin.Vout)] = entry
+	}
+	mp.bytes += size
+	mp.addTotals(entry)
+
+	mp.trim()
+	if mp.entries[key] != entry {
+		return rejectTx(tx, ErrMempoolFull, "pays %.2f, less than the rest of the mempool", feeRate(fee, size))
+	}
+	return nil
+}
+
+// replaceable reports whether entry or one of its ancestors in the mempool
+// signals replacement
+func (mp *Mempool) replaceable(entry *mempoolEntry) bool {
+	if entry.tx.SignalsReplacement() {
+		return true
+	}
+	for ancestor := range mp.ancestors(entry) {
+		if ancestor.tx.SignalsReplacement() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReplacement checks that tx, paying fee for size bytes, may replace
+// the entries it conflicts with, and returns them along with their
+// descendants, which are evicted too. The replacement has to pay a higher
+// fee rate than each conflict and a higher fee than all evicted entries
+// together, by at least incrementalFeeRate for its own size, and must not
+// spend unconfirmed outputs the conflicts did not.
+func (mp *Mempool) checkReplacement(tx *Transaction, fee, size int, conflicts map[*mempoolEntry]bool) (map[*mempoolEntry]bool, error) {
+	evicted := make(map[*mempoolEntry]bool)
+	conflictParents := make(map[string]bool)
+	for conflict := range conflicts {
+		evicted[conflict] = true
+		for descendant := range mp.descendants(conflict) {
+			evicted[descendant] = true
+		}
+		for _, vin := range conflict.tx.Vin {
+			conflictParents[hex.EncodeToString(vin.Txid)] = true
+		}
+		if feeRate(fee, size) <= feeRate(conflict.fee, conflict.size) {
+			return nil, rejectTx(tx, ErrReplacementFee, "pays %.2f, %x pays %.2f", feeRate(fee, size), conflict.tx.ID, feeRate(conflict.fee, conflict.size))
+		}
+	}
+	if len(evicted) > maxReplacementEvictions {
+		return nil, rejectTx(tx, ErrTooManyEvictions, "%d", len(evicted))
+	}
+
+	for _, vin := range tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		parent, ok := mp.entries[parentID]
+		if !ok {
+			continue
+		}
+		if evicted[parent] {
+			return nil, rejectTx(tx, ErrReplacementInputs, "spends %x, which it replaces", parent.tx.ID)
+		}
+		if !conflictParents[parentID] {
+			return nil, rejectTx(tx, ErrReplacementInputs, "spends %x", parent.tx.ID)
+		}
+	}
+
+	evictedFee := 0
+	for entry := range evicted {
+		evictedFee += entry.fee
+	}
+	// the extra fee has to pay for relaying the replacement
+	if float64(fee-evictedFee) < incrementalFeeRate*float64(size)/1000 {
+		return nil, rejectTx(tx, ErrReplacementFee, "pays %d, the replaced transactions pay %d", fee, evictedFee)
+	}
+	return evicted, nil
+}
+
+// trim evicts the entries whose descendant package pays the lowest fee
+// rate until the mempool fits its byte limit. The minimum fee rate is
+// raised above theirs, so they are not accepted right back.
+func (mp *Mempool) trim() {
+	for mp.bytes > mp.maxBytes {
+		worst := mp.evictQueue[0]
+		worstRate := worst.descendantFeeRate()
+		log.Printf("Mempool is full, evicting transaction %x paying %.2f\n", worst.tx.ID, worstRate)
+		mp.remove(worst, true)
+
+		if minRate := worstRate + incrementalFeeRate; minRate > mp.minFeeRate() {
+			mp.rollingMinFeeRate = minRate
+			mp.minFeeRateUpdated = time.Now()
+		}
+	}
+}
+
+// MinFeeRate returns the fee rate a new transaction has to pay
+func (mp *Mempool) MinFeeRate() float64 {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.minFeeRate()
+}
+
+func (mp *Mempool) minFeeRate() float64 {
+	if mp.rollingMinFeeRate > 0 {
+		now := time.Now()
+		halvings := float64(now.Sub(mp.minFeeRateUpdated)) / float64(minFeeRateHalfLife)
+		mp.rollingMinFeeRate /= math.Pow(2, halvings)
+		mp.minFeeRateUpdated = now
+		if mp.rollingMinFeeRate < incrementalFeeRate/2.0 {
+			mp.rollingMinFeeRate = 0
+		}
+	}
+	return math.Max(minRelayFeeRate, mp.rollingMinFeeRate)
+}
+
+// ancestors returns the entries whose outputs entry spends, directly or
+// through other entries
+func (mp *Mempool) ancestors(entry *mempoolEntry) map[*mempoolEntry]bool {
+	found := make(map[*mempoolEntry]bool)
+	stack := []*mempoolEntry{entry}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for parent := range current.parents {
+			if !found[parent] {
+				found[parent] = true
+				stack = append(stack, parent)
+			}
+		}
+	}
+	return found
+}
+
+// descendants returns the entries spending the outputs of entry, directly
+// or through other entries
+func (mp *Mempool) descendants(entry *mempoolEntry) map[*mempoolEntry]bool {
+	found := make(map[*mempoolEntry]bool)
+	stack := []*mempoolEntry{entry}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for child := range current.children {
+			if !found[child] {
+				found[child] = true
+				stack = append(stack, child)
+			}
+		}
+	}
+	return found
+}
+
+// computeTotals sets the ancestor and descendant totals of entry from
+// scratch
+func (mp *Mempool) computeTotals(entry *mempoolEntry) {
+	entry.ancestorFee, entry.ancestorSize = entry.fee, entry.size
+	for ancestor := range mp.ancestors(entry) {
+		entry.ancestorFee += ancestor.fee
+		entry.ancestorSize += ancestor.size
+	}
+	entry.descendantFee, entry.descendantSize = entry.fee, entry.size
+	for descendant := range mp.descendants(entry) {
+		entry.descendantFee += descendant.fee
+		entry.descendantSize += descendant.size
+	}
+}
+
+// addTotals sets the totals of a newly linked entry, queues it for
+// eviction and adds it to the totals of its relatives
+func (mp *Mempool) addTotals(entry *mempoolEntry) {
+	mp.computeTotals(entry)
+	heap.Push(&mp.evictQueue, entry)
+
+	ancestors := mp.ancestors(entry)
+	if len(entry.children) == 0 {
+		for ancestor := range ancestors {
+			ancestor.descendantFee += entry.fee
+			ancestor.descendantSize += entry.size
+			heap.Fix(&mp.evictQueue, ancestor.evictIndex)
+		}
+		return
+	}
+	// the entry joined packages below it as well as above it, which only
+	// happens in a reorganization, so they are recomputed
+	for relative := range ancestors {
+		mp.computeTotals(relative)
+		heap.Fix(&mp.evictQueue, relative.evictIndex)
+	}
+	for relative := range mp.descendants(entry) {
+		mp.computeTotals(relative)
+		heap.Fix(&mp.evictQueue, relative.evictIndex)
+	}
+}
+
+// remove drops an entry, and with it every entry spending its outputs when
+// withDescendants is set
+func (mp *Mempool) remove(entry *mempoolEntry, withDescendants bool) {
+	if mp.entries[hex.EncodeToString(entry.tx.ID)] != entry {
+		return
+	}
+	removed := []*mempoolEntry{entry}
+	if withDescendants {
+		for descendant := range mp.descendants(entry) {
+			removed = append(removed, descendant)
+		}
+	}
+	for _, entry := range removed {
+		mp.removeEntry(entry)
+	}
+}
+
+// removeEntry drops a single entry and takes it out of the totals of its
+// relatives
+func (mp *Mempool) removeEntry(entry *mempoolEntry) {
+	for ancestor := range mp.ancestors(entry) {
+		ancestor.descendantFee -= entry.fee
+		ancestor.descendantSize -= entry.size
+		heap.Fix(&mp.evictQueue, ancestor.evictIndex)
+	}
+	for descendant := range mp.descendants(entry) {
+		descendant.ancestorFee -= entry.fee
+		descendant.ancestorSize -= entry.size
+	}
+	for parent := range entry.parents {
+		delete(parent.children, entry)
+	}
+	for child := range entry.children {
+		delete(child.parents, entry)
+	}
+	heap.Remove(&mp.evictQueue, entry.evictIndex)
+
+	delete(mp.entries, hex.EncodeToString(entry.tx.ID))
+	for _, vin := range entry.tx.Vin {
+		delete(mp.spends, outpointKey(vin.Txid, vin.Vout))
+	}
+	mp.bytes -= entry.size
+}
+
+// ApplyChainUpdate removes the transactions confirmed by connected blocks,
+// along with the entries and orphans that conflict with them, and returns
+// the transactions of disconnected blocks to the pool. It returns the
+// orphans whose parents arrived in a connected block.
+func (mp *Mempool) ApplyChainUpdate(update *ChainUpdate) []*Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var confirmed []*Transaction
+	for _, block := range update.Connected {
+		for _, tx := range block.Transactions {
+			confirmed = append(confirmed, tx)
+			mp.orphans.removeConflicts(tx)
+			if entry, ok := mp.entries[hex.EncodeToString(tx.ID)]; ok {
+				// its children stay, their input is in the chainstate now
+				mp.remove(entry, false)
+			}
+			for _, vin := range tx.Vin {
+				if entry, ok := mp.spends[outpointKey(vin.Txid, vin.Vout)]; ok {
+					log.Printf("Removing transaction %x, it conflicts with %x in block %x\n", entry.tx.ID, tx.ID, block.Hash)
+					mp.remove(entry, true)
+				}
+			}
+		}
+	}
+
+	// disconnected blocks are listed from the old tip down, parents have to
+	// be added first
+	for i := len(update.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range update.Disconnected[i].Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			err := mp.add(tx)
+			if err != nil && !errors.Is(err, ErrTxInMempool) {
+				log.Printf("Dropping transaction of a disconnected block: %v\n", err)
+			}
+		}
+	}
+	if len(update.Disconnected) > 0 {
+		mp.removeUnspendable()
+	}
+	return mp.processOrphans(confirmed)
+}
+
+// removeUnspendable drops the entries spending outputs that left the
+// chainstate in a reorganization and did not come back to the pool
+func (mp *Mempool) removeUnspendable() {
+	var orphaned []*mempoolEntry
+	err := mp.bc.Db.View(func(dbTx *bolt.Tx) error {
+		utxo := dbTx.Bucket([]byte(utxoBucket))
+		for _, entry := range mp.entries {
+			for _, vin := range entry.tx.Vin {
+				if _, ok := mp.entries[hex.EncodeToString(vin.Txid)]; ok {
+					continue
+				}
+				outsBytes := utxo.Get(vin.Txid)
+				if outsBytes == nil {
+					orphaned = append(orphaned, entry)
+					break
+				}
+				if _, ok := DeserializeOutputs(outsBytes).Outputs[vin.Vout]; !ok {
+					orphaned = append(orphaned, entry)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	for _, entry := range orphaned {
+		log.Printf("Removing transaction %x, its inputs were reorganized away\n", entry.tx.ID)
+		mp.remove(entry, true)
+	}
+}
+
+// Has reports whether the transaction is in the mempool
+func (mp *Mempool) Has(txID []byte) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	_, ok := mp.entries[hex.EncodeToString(txID)]
+	return ok
+}
+
+// Get returns the transaction with the given ID
+func (mp *Mempool) Get(txID []byte) (*Transaction, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	entry, ok := mp.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+	return entry.tx, true
+}
+
+// Count returns the number of transactions in the mempool
+func (mp *Mempool) Count() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return len(mp.entries)
+}
+
+// Transactions returns every transaction in the mempool, best paying
+// first. Entries are ranked by the fee rate of their ancestor package, so
+// a parent paying little is taken early when a child pays for it, and
+// parents always come before the children spending them.
+func (mp *Mempool) Transactions() []*Transaction {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	queue := make(packageQueue, 0, len(mp.entries))
+	packages := make(map[*mempoolEntry]*ancestorPackage, len(mp.entries))
+	for _, entry := range mp.entries {
+		pkg := &ancestorPackage{entry: entry, fee: entry.ancestorFee, size: entry.ancestorSize, index: len(queue)}
+		packages[entry] = pkg
+		queue = append(queue, pkg)
+	}
+	heap.Init(&queue)
+
+	txs := make([]*Transaction, 0, len(mp.entries))
+	included := make(map[*mempoolEntry]bool)
+	var include func(entry *mempoolEntry)
+	include = func(entry *mempoolEntry) {
+		if included[entry] {
+			return
+		}
+		for _, vin := range entry.tx.Vin {
+			if parent, ok := mp.entries[hex.EncodeToString(vin.Txid)]; ok {
+				include(parent)
+			}
+		}
+		included[entry] = true
+		txs = append(txs, entry.tx)
+		heap.Remove(&queue, packages[entry].index)
+		// the entry no longer weighs on the packages depending on it
+		for descendant := range mp.descendants(entry) {
+			if !included[descendant] {
+				pkg := packages[descendant]
+				pkg.fee -= entry.fee
+				pkg.size -= entry.size
+				heap.Fix(&queue, pkg.index)
+			}
+		}
+	}
+
+	for queue.Len() > 0 {
+		include(queue[0].entry)
+	}
+	return txs
+}
+
+// ancestorPackage is an entry along with its ancestors that are not in the
+// block being assembled yet
+type ancestorPackage struct {
+	entry *mempoolEntry
+	fee   int
+	size  int
+	index int
+}
+
+// packageQueue is a heap of ancestor packages, the best paying first and
+// the oldest of equal ones
+type packageQueue []*ancestorPackage
+
+func (q packageQueue) Len() int { return len(q) }
+
+func (q packageQueue) Less(i, j int) bool {
+	ri, rj := feeRate(q[i].fee, q[i].size), feeRate(q[j].fee, q[j].size)
+	if ri != rj {
+		return ri > rj
+	}
+	return q[i].entry.seq < q[j].entry.seq
+}
+
+func (q packageQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *packageQueue) Push(x interface{}) {
+	pkg := x.(*ancestorPackage)
+	pkg.index = len(*q)
+	*q = append(*q, pkg)
+}
+
+func (q *packageQueue) Pop() interface{} {
+	old := *q
+	pkg := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return pkg
+}
@@ -0,0 +1,291 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestChain creates a chain in a temporary directory whose genesis
+// coinbase pays the returned wallet
+func newTestChain(t *testing.T) (*BlockChain, *Wallet) {
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	wallet := NewWallet()
+	bc := CreateBlockchain(string(wallet.GetAddress()), "test")
+	t.Cleanup(func() { bc.Db.Close() })
+	UTXOSet{bc}.Reindex()
+	return bc, wallet
+}
+
+// spendOutput builds a transaction paying output vout of parent, which
+// need not be in the chain, less fee to a new wallet
+func spendOutput(wallet *Wallet, parent *Transaction, vout, fee int) *Transaction {
+	return splitOutput(wallet, parent, vout, fee, string(NewWallet().GetAddress()), 1)
+}
+
+// splitOutput builds a transaction paying output vout of parent less fee to
+// address in n equal outputs
+func splitOutput(wallet *Wallet, parent *Transaction, vout, fee int, address string, n int) *Transaction {
+	tx := Transaction{Vin: []TXInput{{Txid: parent.ID, Vout: vout, PubKey: wallet.PublicKey}}}
+	for i := 0; i < n; i++ {
+		tx.Vout = append(tx.Vout, *NewTXOutput((parent.Vout[vout].Value-fee)/n, address))
+	}
+	signSpend(wallet, parent, &tx)
+	return &tx
+}
+
+// signSpend sets the ID of tx, spending from parent only, and signs it
+func signSpend(wallet *Wallet, parent, tx *Transaction) {
+	for i := range tx.Vin {
+		tx.Vin[i].Signature = nil
+	}
+	tx.ID = tx.Hash()
+	tx.Sign(wallet.PrivateKey, map[string]Transaction{hex.EncodeToString(parent.ID): *parent})
+}
+
+// fundOutputs mines a block splitting the genesis coinbase into n outputs
+// paying wallet and returns the transaction holding them
+func fundOutputs(t *testing.T, bc *BlockChain, wallet *Wallet, n int) *Transaction {
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	address := string(wallet.GetAddress())
+	split := splitOutput(wallet, genesis.Transactions[0], 0, 0, address, n)
+	_, _, err = bc.MineBLock([]*Transaction{split, NewCoinbaseTX(address, "", 1, 0)})
+	assert.NoError(t, err)
+	return split
+}
+
+func TestMempoolConflicts(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	utxo := UTXOSet{bc}
+
+	tx1 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 0, false, &utxo)
+	tx2 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 4, 0, false, &utxo)
+	assert.NoError(t, mp.Add(tx1))
+	assert.ErrorIs(t, mp.Add(tx1), ErrTxInMempool)
+	assert.ErrorIs(t, mp.Add(tx2), ErrMempoolConflict, "both spend the genesis coinbase")
+
+	child := spendOutput(wallet, tx1, 1, 0)
+	assert.NoError(t, mp.Add(child), "spends the change of a mempool entry")
+	assert.Equal(t, []*Transaction{tx1, child}, mp.Transactions())
+
+	tx2.Vin = append(tx2.Vin, tx2.Vin[0])
+	tx2.ID = unsignedHash(tx2)
+	assert.ErrorIs(t, NewMempool(bc).Add(tx2), ErrDuplicateInput)
+	assert.Equal(t, 2, mp.Count())
+}
+
+func TestMempoolApplyChainUpdate(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	utxo := UTXOSet{bc}
+
+	tx1 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 0, false, &utxo)
+	tx2 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 4, 0, false, &utxo)
+	assert.NoError(t, mp.Add(tx1))
+	assert.NoError(t, mp.Add(spendOutput(wallet, tx1, 1, 0)))
+
+	// a block confirming a conflicting transaction evicts tx1 and its child
+	coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", 1, 0)
+	block := NewBlock([]*Transaction{tx2, coinbase}, bc.Tip(), 1, activeNetParams.PowLimitBits, time.Now().Unix()+1)
+	update, err := bc.AddBlock(block)
+	assert.NoError(t, err)
+	mp.ApplyChainUpdate(update)
+	assert.Equal(t, 0, mp.Count())
+	assert.Equal(t, 0, mp.bytes)
+	assert.Empty(t, mp.spends)
+}
+
+func TestMempoolFeeRateOrder(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	funds := fundOutputs(t, bc, wallet, 3)
+
+	single := spendOutput(wallet, funds, 0, 1)
+	parent := splitOutput(wallet, funds, 1, 0, string(wallet.GetAddress()), 1)
+	child := spendOutput(wallet, parent, 0, 3)
+	for _, tx := range []*Transaction{single, parent, child} {
+		assert.NoError(t, mp.Add(tx))
+	}
+
+	// the child pays for its parent, so the package outbids single
+	txs := mp.Transactions()
+	assert.Equal(t, []*Transaction{parent, child, single}, txs)
+
+	template := bc.NewBlockTemplate(string(wallet.GetAddress()), txs)
+	assert.Equal(t, append(txs, template[3]), template)
+	assert.Equal(t, CalcBlockSubsidy(2)+4, template[3].Vout[0].Value)
+	_, update, err := bc.MineBLock(template)
+	assert.NoError(t, err)
+	mp.ApplyChainUpdate(update)
+	assert.Equal(t, 0, mp.Count())
+}
+
+func TestMempoolEviction(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	funds := fundOutputs(t, bc, wallet, 3)
+
+	cheap := spendOutput(wallet, funds, 0, 0)
+	best := spendOutput(wallet, funds, 1, 2)
+	good := spendOutput(wallet, funds, 2, 1)
+	mp.maxBytes = len(cheap.Serialize()) + len(best.Serialize()) + len(good.Serialize()) - 1
+
+	assert.NoError(t, mp.Add(cheap))
+	assert.NoError(t, mp.Add(best))
+	assert.NoError(t, mp.Add(good), "evicts cheap")
+	assert.False(t, mp.Has(cheap.ID))
+	assert.Equal(t, 2, mp.Count())
+	assert.InDelta(t, float64(incrementalFeeRate), mp.MinFeeRate(), 0.01)
+
+	assert.ErrorIs(t, mp.Add(cheap), ErrInsufficientFee)
+}
+
+func TestMempoolReplacement(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	funds := fundOutputs(t, bc, wallet, 2)
+
+	original := splitOutput(wallet, funds, 0, 1, string(wallet.GetAddress()), 1)
+	assert.True(t, original.SignalsReplacement())
+	child := spendOutput(wallet, original, 0, 1)
+	assert.NoError(t, mp.Add(original))
+	assert.NoError(t, mp.Add(child))
+
+	// the replacement has to outbid the original and its child together
+	assert.ErrorIs(t, mp.Add(spendOutput(wallet, funds, 0, 2)), ErrReplacementFee)
+	replacement := spendOutput(wallet, funds, 0, 3)
+	assert.NoError(t, mp.Add(replacement))
+	assert.False(t, mp.Has(original.ID))
+	assert.False(t, mp.Has(child.ID))
+	assert.Equal(t, 1, mp.Count())
+
+	final := spendOutput(wallet, funds, 1, 0)
+	final.Vin[0].Sequence = SequenceFinal
+	signSpend(wallet, funds, final)
+	assert.NoError(t, mp.Add(final))
+	assert.ErrorIs(t, mp.Add(spendOutput(wallet, funds, 1, 2)), ErrMempoolConflict)
+}
+
+func TestBumpedTransaction(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	utxo := UTXOSet{bc}
+
+	tx := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 1, true, &utxo)
+	assert.NoError(t, mp.Add(tx))
+
+	_, err := NewBumpedTransaction(wallet, tx, changeOutput, 1, &utxo)
+	assert.Error(t, err, "the fee has to go up")
+	_, err = NewBumpedTransaction(wallet, tx, 0, 3, &utxo)
+	assert.Error(t, err, "the payment is not change")
+	_, err = NewBumpedTransaction(wallet, tx, -1, 3, &utxo)
+	assert.Error(t, err, "no change")
+	bumped, err := NewBumpedTransaction(wallet, tx, changeOutput, 3, &utxo)
+	assert.NoError(t, err)
+	assert.Equal(t, tx.Vout[0], bumped.Vout[0], "the payment is unchanged")
+	assert.Equal(t, tx.Vout[1].Value-2, bumped.Vout[1].Value)
+
+	assert.NoError(t, mp.Add(bumped))
+	assert.False(t, mp.Has(tx.ID))
+	assert.True(t, mp.Has(bumped.ID))
+
+	final := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 1, false, &utxo)
+	_, err = NewBumpedTransaction(wallet, final, changeOutput, 3, &utxo)
+	assert.Error(t, err, "does not signal replacement")
+
+	// paying the wallet itself, only the change output pays the fee
+	self := NewUTXOTransaction(wallet, string(wallet.GetAddress()), 3, 1, true, &utxo)
+	bumped, err = NewBumpedTransaction(wallet, self, changeOutput, 3, &utxo)
+	assert.NoError(t, err)
+	assert.Equal(t, self.Vout[0], bumped.Vout[0])
+	assert.Equal(t, self.Vout[1].Value-2, bumped.Vout[1].Value)
+}
+
+func TestMempoolRejectsOutputOverflow(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+
+	// the outputs wrap to a total below the input
+	tx := splitOutput(wallet, genesis.Transactions[0], 0, 0, string(wallet.GetAddress()), 1)
+	tx.Vout = []TXOutput{{math.MaxInt64, tx.Vout[0].PubKeyHash}, {math.MaxInt64, tx.Vout[0].PubKeyHash}, {2, tx.Vout[0].PubKeyHash}}
+	tx.ID = unsignedHash(tx)
+	assert.ErrorIs(t, mp.Add(tx), ErrBadOutputValue)
+	assert.Equal(t, 0, mp.Count())
+}
+
+func TestMempoolRejectsTxWithoutInputs(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+
+	tx := &Transaction{Vout: []TXOutput{*NewTXOutput(0, string(wallet.GetAddress()))}}
+	tx.ID = tx.Hash()
+	assert.ErrorIs(t, mp.Add(tx), ErrNoInputs)
+	_, err := mp.ProcessTransaction(tx, nil)
+	assert.ErrorIs(t, err, ErrNoInputs)
+	assert.Equal(t, 0, mp.Count())
+}
+
+// assertPackageTotals checks the running package totals of every entry
+// against totals computed from scratch
+func assertPackageTotals(t *testing.T, mp *Mempool) {
+	for _, entry := range mp.entries {
+		running := *entry
+		mp.computeTotals(entry)
+		assert.Equal(t, [4]int{entry.ancestorFee, entry.ancestorSize, entry.descendantFee, entry.descendantSize},
+			[4]int{running.ancestorFee, running.ancestorSize, running.descendantFee, running.descendantSize})
+		assert.Equal(t, entry, mp.evictQueue[entry.evictIndex])
+	}
+}
+
+func TestMempoolPackageTotals(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	address := string(wallet.GetAddress())
+	funds := fundOutputs(t, bc, wallet, 2)
+	fundsBlock, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+
+	parent := splitOutput(wallet, funds, 0, 1, address, 2)
+	child := splitOutput(wallet, parent, 0, 1, address, 1)
+	sibling := spendOutput(wallet, parent, 1, 2)
+	grandchild := spendOutput(wallet, child, 0, 1)
+	for _, tx := range []*Transaction{parent, child, sibling, grandchild} {
+		assert.NoError(t, mp.Add(tx))
+		assertPackageTotals(t, mp)
+	}
+	root := mp.entries[hex.EncodeToString(parent.ID)]
+	assert.Equal(t, 1+1+2+1, root.descendantFee)
+
+	// confirming the parent leaves its children behind
+	confirmed, update, err := bc.MineBLock([]*Transaction{parent, NewCoinbaseTX(address, "", 2, 1)})
+	assert.NoError(t, err)
+	mp.ApplyChainUpdate(update)
+	assert.Equal(t, 3, mp.Count())
+	assertPackageTotals(t, mp)
+
+	// a longer branch from the funding block sends the parent back to the
+	// pool, below the children already there
+	fork := mineOn(&fundsBlock, nil, address, confirmed)
+	_, err = bc.AddBlock(fork)
+	assert.NoError(t, err)
+	update, err = bc.AddBlock(mineOn(fork, nil, address, nil))
+	assert.NoError(t, err)
+	assert.Len(t, update.Disconnected, 1)
+	mp.ApplyChainUpdate(update)
+	assert.Equal(t, 4, mp.Count())
+	assertPackageTotals(t, mp)
+	assert.Equal(t, 1+1+2+1, mp.entries[hex.EncodeToString(parent.ID)].descendantFee)
+	assert.Equal(t, parent, mp.Transactions()[0])
+}
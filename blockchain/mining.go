@@ -0,0 +1,186 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+// Miner mines blocks from the mempool in its own goroutine, so the peer
+// whose transaction starts a block keeps reading its connection
+type Miner struct {
+	bc      *BlockChain
+	address string
+	// wake holds a pending request to look at the mempool
+	wake chan struct{}
+}
+
+func NewMiner(bc *BlockChain, address string) *Miner {
+	return &Miner{
+		bc:      bc,
+		address: address,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start mines whenever Notify is called until the process exits
+func (m *Miner) Start() {
+	go func() {
+		for range m.wake {
+			if mempool.Count() < 2 {
+				continue
+			}
+			for mempool.Count() > 0 && m.mineBlock() {
+			}
+		}
+	}()
+}
+
+// Notify tells the miner the mempool changed. It never blocks, a request
+// already pending covers this one.
+func (m *Miner) Notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// mineBlock mines one block from the mempool and reports whether it became
+// the tip
+func (m *Miner) mineBlock() bool {
+	txs := m.bc.NewBlockTemplate(m.address, mempool.Transactions())
+	if len(txs) == 1 {
+		log.Println("All transactions are invalid, waiting for new ones")
+		return false
+	}
+
+	block, update, err := m.bc.MineBLock(txs)
+	if err != nil {
+		log.Printf("Mined block %x was not added: %v\n", block.Hash, err)
+		return false
+	}
+	applyChainUpdate(update)
+	if len(update.Connected) == 0 {
+		log.Printf("Mined block %x is not on the best chain\n", block.Hash)
+		return false
+	}
+	log.Println("New block is mined")
+	relayBlock(block.Hash)
+	return true
+}
+
+// NewBlockTemplate picks the transactions of the next block from candidates
+// and appends a coinbase paying the subsidy and their fees to minerAddress.
+// Candidates may spend the outputs of earlier candidates, so they are taken
+// in order, which should put parents first. Invalid candidates are skipped,
+// and so are those spending an output already spent by a picked one and
+// those that would push the block over the size or signature operation
+// limits.
+func (bc *BlockChain) NewBlockTemplate(minerAddress string, candidates []*Transaction) []*Transaction {
+	height := bc.GetBestHeight() + 1
+
+	// a coinbase with the largest possible reward, as the fees cannot top
+	// the money supply, stands in for the real one while sizing the block
+	placeholder := NewCoinbaseTX(minerAddress, "", height, CalcMaxSupply())
+	size := len((&Block{Transactions: []*Transaction{placeholder}}).Serialize())
+	sigOps := 0
+	fees := 0
+
+	var txs []*Transaction
+	spent := make(map[string]bool)
+	picked := make(map[string]*Transaction)
+	err := bc.Db.View(func(dbTx *bolt.Tx) error {
+		utxo := dbTx.Bucket([]byte(utxoBucket))
+		for _, tx := range candidates {
+			if spendsAny(tx, spent) {
+				log.Printf("Transaction %x conflicts with the block, leaving it out\n", tx.ID)
+				continue
+			}
+			fee, prevTXs, ok := resolveInputs(utxo, tx, picked, height)
+			if !ok || fee < 0 || !tx.Verify(prevTXs) {
+				continue
+			}
+			txSize := len(tx.Serialize())
+			if size+txSize > activeNetParams.MaxBlockSize || sigOps+tx.SigOpCount() > activeNetParams.MaxBlockSigOps {
+				log.Printf("Transaction %x does not fit in the block, leaving it for the next one\n", tx.ID)
+				continue
+			}
+			txs = append(txs, tx)
+			picked[hex.EncodeToString(tx.ID)] = tx
+			for _, vin := range tx.Vin {
+				spent[outpointKey(vin.Txid, vin.Vout)] = true
+			}
+			size += txSize
+			sigOps += tx.SigOpCount()
+			fees += fee
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	return append(txs, NewCoinbaseTX(minerAddress, "", height, fees))
+}
+
+// resolveInputs looks up the outputs tx spends, in picked or in the
+// chainstate, and returns its fee and the previous transactions to verify
+// it with. It fails when an output is missing, immature at height or not
+// owned by the input's key.
+func resolveInputs(utxo *bolt.Bucket, tx *Transaction, picked map[string]*Transaction, height int) (int, map[string]Transaction, bool) {
+	fee := 0
+	prevTXs := make(map[string]Transaction)
+	for _, vin := range tx.Vin {
+		var out TXOutput
+		prevID := hex.EncodeToString(vin.Txid)
+		if parent, ok := picked[prevID]; ok {
+			if vin.Vout < 0 || vin.Vout >= len(parent.Vout) {
+				return 0, nil, false
+			}
+			out = parent.Vout[vin.Vout]
+		} else {
+			outsBytes := utxo.Get(vin.Txid)
+			if outsBytes == nil {
+				return 0, nil, false
+			}
+			outs := DeserializeOutputs(outsBytes)
+			var ok bool
+			out, ok = outs.Outputs[vin.Vout]
+			if !ok || !outs.IsMature(height) {
+				return 0, nil, false
+			}
+		}
+		if !vin.UsesKey(out.PubKeyHash) {
+			return 0, nil, false
+		}
+		fee += out.Value
+
+		prevTX, ok := prevTXs[prevID]
+		if !ok {
+			prevTX = Transaction{ID: vin.Txid}
+		}
+		for len(prevTX.Vout) <= vin.Vout {
+			prevTX.Vout = append(prevTX.Vout, TXOutput{})
+		}
+		prevTX.Vout[vin.Vout] = out
+		prevTXs[prevID] = prevTX
+	}
+	for _, out := range tx.Vout {
+		fee -= out.Value
+	}
+	return fee, prevTXs, true
+}
+
+// spendsAny reports whether tx spends one of the outpoints in spent or the
+// same outpoint twice
+func spendsAny(tx *Transaction, spent map[string]bool) bool {
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		outpoint := outpointKey(vin.Txid, vin.Vout)
+		if spent[outpoint] || seen[outpoint] {
+			return true
+		}
+		seen[outpoint] = true
+	}
+	return false
+}
@@ -0,0 +1,413 @@
+package blockchain
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"net"
+	"sync"
+)
+
+// Connections are encrypted with the Noise XX handshake
+// (noiseprotocol.org): both sides exchange ephemeral keys, then send their
+// static node keys encrypted, so after three messages each side knows the
+// other's static key and shares a pair of transport keys. The network
+// magic is the prologue, so nodes of different networks cannot connect.
+//
+// Every Noise message, handshake or transport, is sent with a 2-byte
+// big-endian length prefix. Wire messages are split over as many
+// transport messages as they need.
+const (
+	noiseProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+	noiseMaxMessage   = 65535
+	noiseKeyLength    = 32
+	noiseTagLength    = 16
+	noiseMaxPlaintext = noiseMaxMessage - noiseTagLength
+)
+
+var (
+	ErrHandshakeFailed = errors.New("noise handshake failed")
+	ErrDecryptFailed   = errors.New("noise message failed to authenticate")
+	ErrNonceExhausted  = errors.New("noise nonce exhausted")
+)
+
+// noiseCipher is the CipherState of the Noise spec
+type noiseCipher struct {
+	key   []byte
+	nonce uint64
+}
+
+func (c *noiseCipher) hasKey() bool {
+	return c.key != nil
+}
+
+func (c *noiseCipher) nonceBytes() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	return nonce
+}
+
+func (c *noiseCipher) encrypt(ad, plaintext []byte) ([]byte, error) {
+	if c.nonce == ^uint64(0) {
+		return nil, ErrNonceExhausted
+	}
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, c.nonceBytes(), plaintext, ad)
+	c.nonce++
+	return ciphertext, nil
+}
+
+func (c *noiseCipher) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if c.nonce == ^uint64(0) {
+		return nil, ErrNonceExhausted
+	}
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, c.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	c.nonce++
+	return plaintext, nil
+}
+
+// noiseSymmetric is the SymmetricState of the Noise spec
+type noiseSymmetric struct {
+	cipher noiseCipher
+	ck     []byte
+	h      []byte
+}
+
+func newNoiseSymmetric(prologue []byte) *noiseSymmetric {
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocolName)
+	s := &noiseSymmetric{ck: h, h: h}
+	s.mixHash(prologue)
+	return s
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// noiseHKDF derives two keys from the chaining key and input key material
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	temp := hmacSHA256(ck, ikm)
+	out1 := hmacSHA256(temp, []byte{1})
+	out2 := hmacSHA256(temp, out1, []byte{2})
+	return out1, out2
+}
+
+func (s *noiseSymmetric) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+func (s *noiseSymmetric) mixKey(ikm []byte) {
+	var key []byte
+	s.ck, key = noiseHKDF(s.ck, ikm)
+	s.cipher = noiseCipher{key: key}
+}
+
+func (s *noiseSymmetric) encryptAndHash(plaintext []byte) ([]byte, error) {
+	if !s.cipher.hasKey() {
+		s.mixHash(plaintext)
+		return plaintext, nil
+	}
+	ciphertext, err := s.cipher.encrypt(s.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *noiseSymmetric) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if !s.cipher.hasKey() {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	plaintext, err := s.cipher.decrypt(s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the cipher of the initiator to responder direction first
+func (s *noiseSymmetric) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(s.ck, nil)
+	return &noiseCipher{key: k1}, &noiseCipher{key: k2}
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	if len(msg) > noiseMaxMessage {
+		return ErrPayloadTooLarge
+	}
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func dh(private *ecdh.PrivateKey, public []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	secret, err := private.ECDH(pub)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	return secret, nil
+}
+
+// noiseHandshake runs the XX handshake over conn with static as our node
+// key and returns the encrypted connection
+func noiseHandshake(conn net.Conn, static *ecdh.PrivateKey, initiator bool, prologue []byte) (*secureConn, error) {
+	s := newNoiseSymmetric(prologue)
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteEphemeral, remoteStatic []byte
+	writeEphemeral := func() []byte {
+		s.mixHash(e.PublicKey().Bytes())
+		return e.PublicKey().Bytes()
+	}
+	readEphemeral := func(msg []byte) ([]byte, error) {
+		if len(msg) < noiseKeyLength {
+			return nil, ErrHandshakeFailed
+		}
+		remoteEphemeral = msg[:noiseKeyLength]
+		s.mixHash(remoteEphemeral)
+		return msg[noiseKeyLength:], nil
+	}
+	writeStatic := func(msg []byte) ([]byte, error) {
+		ciphertext, err := s.encryptAndHash(static.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+		return append(msg, ciphertext...), nil
+	}
+	readStatic := func(msg []byte) ([]byte, error) {
+		if len(msg) < noiseKeyLength+noiseTagLength {
+			return nil, ErrHandshakeFailed
+		}
+		key, err := s.decryptAndHash(msg[:noiseKeyLength+noiseTagLength])
+		if err != nil {
+			return nil, err
+		}
+		remoteStatic = key
+		return msg[noiseKeyLength+noiseTagLength:], nil
+	}
+	mixDH := func(private *ecdh.PrivateKey, public []byte) error {
+		secret, err := dh(private, public)
+		if err != nil {
+			return err
+		}
+		s.mixKey(secret)
+		return nil
+	}
+	// every handshake message ends with an empty payload, which still
+	// authenticates the transcript once there is a key
+	writePayload := func(msg []byte) error {
+		ciphertext, err := s.encryptAndHash(nil)
+		if err != nil {
+			return err
+		}
+		return writeNoiseMessage(conn, append(msg, ciphertext...))
+	}
+	readPayload := func(msg []byte) error {
+		payload, err := s.decryptAndHash(msg)
+		if err != nil {
+			return err
+		}
+		if len(payload) != 0 {
+			return ErrHandshakeFailed
+		}
+		return nil
+	}
+
+	if initiator {
+		// -> e
+		err = writePayload(writeEphemeral())
+		if err != nil {
+			return nil, err
+		}
+		// <- e, ee, s, es
+		msg, err := readNoiseMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg, err = readEphemeral(msg); err != nil {
+			return nil, err
+		}
+		if err = mixDH(e, remoteEphemeral); err != nil {
+			return nil, err
+		}
+		if msg, err = readStatic(msg); err != nil {
+			return nil, err
+		}
+		if err = mixDH(e, remoteStatic); err != nil {
+			return nil, err
+		}
+		if err = readPayload(msg); err != nil {
+			return nil, err
+		}
+		// -> s, se
+		if msg, err = writeStatic(nil); err != nil {
+			return nil, err
+		}
+		if err = mixDH(static, remoteEphemeral); err != nil {
+			return nil, err
+		}
+		if err = writePayload(msg); err != nil {
+			return nil, err
+		}
+		send, recv := s.split()
+		return newSecureConn(conn, send, recv, remoteStatic), nil
+	}
+
+	// -> e
+	msg, err := readNoiseMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msg, err = readEphemeral(msg); err != nil {
+		return nil, err
+	}
+	if err = readPayload(msg); err != nil {
+		return nil, err
+	}
+	// <- e, ee, s, es
+	msg = writeEphemeral()
+	if err = mixDH(e, remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if msg, err = writeStatic(msg); err != nil {
+		return nil, err
+	}
+	if err = mixDH(static, remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if err = writePayload(msg); err != nil {
+		return nil, err
+	}
+	// -> s, se
+	msg, err = readNoiseMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msg, err = readStatic(msg); err != nil {
+		return nil, err
+	}
+	if err = mixDH(e, remoteStatic); err != nil {
+		return nil, err
+	}
+	if err = readPayload(msg); err != nil {
+		return nil, err
+	}
+	recv, send := s.split()
+	return newSecureConn(conn, send, recv, remoteStatic), nil
+}
+
+// secureConn encrypts everything written to and decrypts everything read
+// from the underlying connection with the keys of a finished handshake
+type secureConn struct {
+	net.Conn
+	// remoteKey is the verified static key of the other side
+	remoteKey []byte
+
+	writeMu sync.Mutex
+	send    *noiseCipher
+
+	readMu  sync.Mutex
+	recv    *noiseCipher
+	pending []byte
+}
+
+func newSecureConn(conn net.Conn, send, recv *noiseCipher, remoteKey []byte) *secureConn {
+	return &secureConn{Conn: conn, send: send, recv: recv, remoteKey: remoteKey}
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > noiseMaxPlaintext {
+			chunk = chunk[:noiseMaxPlaintext]
+		}
+		ciphertext, err := c.send.encrypt(nil, chunk)
+		if err != nil {
+			return written, err
+		}
+		err = writeNoiseMessage(c.Conn, ciphertext)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		ciphertext, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.pending, err = c.recv.decrypt(nil, ciphertext)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// sameKey compares keys in constant time
+func sameKey(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
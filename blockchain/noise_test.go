@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func handshakePair(t *testing.T, initiatorPrologue, responderPrologue []byte) (*ecdh.PrivateKey, *ecdh.PrivateKey, *secureConn, *secureConn, error, error) {
+	initiatorKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	responderKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	type result struct {
+		conn *secureConn
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		conn, err := noiseHandshake(b, responderKey, false, responderPrologue)
+		if err != nil {
+			b.Close()
+		}
+		done <- result{conn, err}
+	}()
+	initiator, initiatorErr := noiseHandshake(a, initiatorKey, true, initiatorPrologue)
+	if initiatorErr != nil {
+		a.Close()
+	}
+	responder := <-done
+	return initiatorKey, responderKey, initiator, responder.conn, initiatorErr, responder.err
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	initiatorKey, responderKey, initiator, responder, err1, err2 := handshakePair(t, []byte("net"), []byte("net"))
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, responderKey.PublicKey().Bytes(), initiator.remoteKey)
+	assert.Equal(t, initiatorKey.PublicKey().Bytes(), responder.remoteKey)
+
+	// wire messages larger than one Noise message are split and joined
+	payload := bytes.Repeat([]byte{7}, 3*noiseMaxMessage)
+	go func() {
+		assert.NoError(t, writeMessage(initiator, "block", payload))
+	}()
+	command, received, err := readMessage(responder)
+	assert.NoError(t, err)
+	assert.Equal(t, "block", command)
+	assert.Equal(t, payload, received)
+}
+
+func TestNoiseHandshakeOtherNetwork(t *testing.T) {
+	_, _, _, _, err1, err2 := handshakePair(t, []byte("mainnet"), []byte("testnet"))
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+}
@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/boltdb/bolt"
+	"log"
+	"time"
+)
+
+const (
+	// maxOrphanTransactions bounds the orphan pool, a random orphan is
+	// evicted to make room for a new one
+	maxOrphanTransactions = 100
+	// maxOrphanTxSize is the largest orphan kept, its inputs cannot be
+	// checked so it is not worth much memory
+	maxOrphanTxSize = 100000
+	// orphanTTL is how long an orphan waits for its parents
+	orphanTTL = 20 * time.Minute
+)
+
+// ErrOrphanTransaction is returned by ProcessTransaction for a transaction
+// that waits in the orphan pool for its parents
+var ErrOrphanTransaction = errors.New("transaction spends from unknown transactions")
+
+type orphanEntry struct {
+	tx      *Transaction
+	peer    *Peer
+	expires time.Time
+}
+
+// orphanPool holds transactions spending outputs of transactions we have
+// not seen yet, until their parents arrive. It is guarded by the mempool
+// lock.
+type orphanPool struct {
+	orphans map[string]*orphanEntry
+	// byParent maps the ID of each transaction an orphan spends from to
+	// the orphans spending it
+	byParent map[string]map[string]*orphanEntry
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		orphans:  make(map[string]*orphanEntry),
+		byParent: make(map[string]map[string]*orphanEntry),
+	}
+}
+
+func (op *orphanPool) add(tx *Transaction, peer *Peer) {
+	key := hex.EncodeToString(tx.ID)
+	if _, ok := op.orphans[key]; ok {
+		return
+	}
+	if size := len(tx.Serialize()); size > maxOrphanTxSize {
+		log.Printf("Dropping orphan transaction %x of %d bytes\n", tx.ID, size)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range op.orphans {
+		if now.After(entry.expires) {
+			op.remove(entry)
+		}
+	}
+	// map iteration order is random, so is the orphan evicted
+	for _, entry := range op.orphans {
+		if len(op.orphans) < maxOrphanTransactions {
+			break
+		}
+		op.remove(entry)
+	}
+
+	entry := &orphanEntry{tx: tx, peer: peer, expires: now.Add(orphanTTL)}
+	op.orphans[key] = entry
+	for _, vin := range tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		if op.byParent[parentID] == nil {
+			op.byParent[parentID] = make(map[string]*orphanEntry)
+		}
+		op.byParent[parentID][key] = entry
+	}
+}
+
+func (op *orphanPool) remove(entry *orphanEntry) {
+	key := hex.EncodeToString(entry.tx.ID)
+	delete(op.orphans, key)
+	for _, vin := range entry.tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		delete(op.byParent[parentID], key)
+		if len(op.byParent[parentID]) == 0 {
+			delete(op.byParent, parentID)
+		}
+	}
+}
+
+// removeConflicts drops the orphans spending an output tx spends
+func (op *orphanPool) removeConflicts(tx *Transaction) {
+	spent := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		spent[outpointKey(vin.Txid, vin.Vout)] = true
+	}
+	for _, entry := range op.orphans {
+		if spendsAny(entry.tx, spent) {
+			op.remove(entry)
+		}
+	}
+}
+
+// ProcessTransaction adds tx to the mempool, or to the orphan pool when it
+// spends from a transaction that is neither in the mempool nor in the
+// chainstate. It returns the transactions accepted to the mempool: tx and
+// the orphans waiting for it, which may in turn free other orphans. An
+// orphaned tx is reported as ErrOrphanTransaction, while one spending a
+// missing output of a known transaction is rejected with ErrMissingInput.
+func (mp *Mempool) ProcessTransaction(tx *Transaction, from *Peer) ([]*Transaction, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	err := mp.add(tx)
+	if errors.Is(err, ErrMissingInput) {
+		if missing := mp.missingParents(tx); len(missing) > 0 {
+			mp.orphans.add(tx, from)
+			return nil, rejectTx(tx, ErrOrphanTransaction, "%d unknown parents", len(missing))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]*Transaction{tx}, mp.processOrphans([]*Transaction{tx})...), nil
+}
+
+// processOrphans retries the orphans spending from the given transactions,
+// which just entered the mempool or the chain, and returns the ones
+// accepted
+func (mp *Mempool) processOrphans(parents []*Transaction) []*Transaction {
+	var accepted []*Transaction
+	for len(parents) > 0 {
+		parentID := hex.EncodeToString(parents[0].ID)
+		parents = parents[1:]
+
+		for _, entry := range mp.orphans.byParent[parentID] {
+			mp.orphans.remove(entry)
+			err := mp.add(entry.tx)
+			if errors.Is(err, ErrMissingInput) && len(mp.missingParents(entry.tx)) > 0 {
+				// still waiting for another parent
+				mp.orphans.add(entry.tx, entry.peer)
+				continue
+			}
+			if err != nil {
+				log.Printf("Dropping orphan: %v\n", err)
+				continue
+			}
+			log.Printf("Accepted orphan transaction %x\n", entry.tx.ID)
+			accepted = append(accepted, entry.tx)
+			parents = append(parents, entry.tx)
+		}
+	}
+	return accepted
+}
+
+// MissingParents returns the IDs of the transactions tx spends from that
+// are neither in the mempool nor in the chainstate
+func (mp *Mempool) MissingParents(tx *Transaction) [][]byte {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.missingParents(tx)
+}
+
+func (mp *Mempool) missingParents(tx *Transaction) [][]byte {
+	var missing [][]byte
+	seen := make(map[string]bool)
+	err := mp.bc.Db.View(func(dbTx *bolt.Tx) error {
+		utxo := dbTx.Bucket([]byte(utxoBucket))
+		for _, vin := range tx.Vin {
+			parentID := hex.EncodeToString(vin.Txid)
+			if seen[parentID] {
+				continue
+			}
+			seen[parentID] = true
+			if _, ok := mp.entries[parentID]; !ok && utxo.Get(vin.Txid) == nil {
+				missing = append(missing, vin.Txid)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	return missing
+}
+
+// RemovePeerOrphans drops the orphans received from p
+func (mp *Mempool) RemovePeerOrphans(p *Peer) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, entry := range mp.orphans.orphans {
+		if entry.peer == p {
+			mp.orphans.remove(entry)
+		}
+	}
+}
+
+// OrphanCount returns the number of transactions in the orphan pool
+func (mp *Mempool) OrphanCount() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return len(mp.orphans.orphans)
+}
@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanParentInMempool(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+
+	parent := splitOutput(wallet, genesis.Transactions[0], 0, 0, string(wallet.GetAddress()), 1)
+	child := spendOutput(wallet, parent, 0, 0)
+
+	accepted, err := mp.ProcessTransaction(child, nil)
+	assert.ErrorIs(t, err, ErrOrphanTransaction)
+	assert.Empty(t, accepted)
+	assert.Equal(t, 1, mp.OrphanCount())
+	assert.Equal(t, [][]byte{parent.ID}, mp.MissingParents(child))
+
+	accepted, err = mp.ProcessTransaction(parent, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Transaction{parent, child}, accepted)
+	assert.Equal(t, 0, mp.OrphanCount())
+	assert.Equal(t, 2, mp.Count())
+
+	// the parent is known, so an output it does not have is no orphan
+	bogus := spendOutput(wallet, parent, 0, 0)
+	bogus.Vin[0].Vout = 1
+	bogus.ID = unsignedHash(bogus)
+	_, err = mp.ProcessTransaction(bogus, nil)
+	assert.ErrorIs(t, err, ErrMissingInput)
+	assert.Equal(t, 0, mp.OrphanCount())
+}
+
+func TestOrphanParentInBlock(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	mp := NewMempool(bc)
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+
+	parent := splitOutput(wallet, genesis.Transactions[0], 0, 0, string(wallet.GetAddress()), 1)
+	child := spendOutput(wallet, parent, 0, 0)
+	_, err = mp.ProcessTransaction(child, nil)
+	assert.ErrorIs(t, err, ErrOrphanTransaction)
+
+	_, update, err := bc.MineBLock([]*Transaction{parent, NewCoinbaseTX(string(wallet.GetAddress()), "", 1, 0)})
+	assert.NoError(t, err)
+	accepted := mp.ApplyChainUpdate(update)
+	assert.Equal(t, []*Transaction{child}, accepted)
+	assert.True(t, mp.Has(child.ID))
+	assert.Equal(t, 0, mp.OrphanCount())
+}
+
+func TestOrphanPoolLimit(t *testing.T) {
+	op := newOrphanPool()
+	for i := 0; i < maxOrphanTransactions+10; i++ {
+		tx := &Transaction{ID: []byte{byte(i >> 8), byte(i)}, Vin: []TXInput{{Txid: []byte{'p', byte(i)}}}}
+		op.add(tx, nil)
+	}
+	assert.Len(t, op.orphans, maxOrphanTransactions)
+	parents := 0
+	for _, orphans := range op.byParent {
+		parents += len(orphans)
+	}
+	assert.Equal(t, maxOrphanTransactions, parents, "evicted orphans leave the parent index")
+}
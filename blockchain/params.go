@@ -0,0 +1,88 @@
+package blockchain
+
+import "time"
+
+// NetParams holds the consensus settings of a network. Every node on a
+// network has to run with the same values.
+type NetParams struct {
+	Name string
+	// Net is the magic number that starts every message on the network
+	Net uint32
+	// DefaultSeeds are the nodes connected to first unless SEEDS is set
+	DefaultSeeds []string
+
+	// PowLimitBits is the easiest target allowed, in compact form. The
+	// genesis block is mined at this difficulty.
+	PowLimitBits uint32
+	// TargetBlockInterval is the block spacing difficulty retargeting aims at
+	TargetBlockInterval time.Duration
+	// RetargetInterval is the number of blocks between difficulty changes
+	RetargetInterval int
+	// MaxRetargetFactor bounds how far one retarget can move the target
+	MaxRetargetFactor int64
+	// MaxTimeDrift is how far ahead of the network-adjusted time a block
+	// timestamp may be
+	MaxTimeDrift time.Duration
+
+	// InitialSubsidy is the block reward before the first halving
+	InitialSubsidy int
+	// SubsidyHalvingInterval is the number of blocks between halvings
+	SubsidyHalvingInterval int
+	// CoinbaseMaturity is how many blocks deep a coinbase must be before
+	// its outputs can be spent
+	CoinbaseMaturity int
+
+	// MaxBlockSize is the largest serialized block in bytes
+	MaxBlockSize int
+	// MaxBlockSigOps caps the signature checks, one per input, in a block
+	MaxBlockSigOps int
+}
+
+var MainNetParams = NetParams{
+	Name:                "mainnet",
+	Net:                 0xd9b4bef9,
+	DefaultSeeds:        []string{"localhost:3000"},
+	PowLimitBits:        0x1f010000,
+	TargetBlockInterval: time.Minute,
+	RetargetInterval:    60,
+	MaxRetargetFactor:   4,
+	MaxTimeDrift:        2 * time.Hour,
+
+	InitialSubsidy:         10,
+	SubsidyHalvingInterval: 210000,
+	CoinbaseMaturity:       100,
+
+	MaxBlockSize:   1000000,
+	MaxBlockSigOps: 20000,
+}
+
+var TestNetParams = NetParams{
+	Name:                "testnet",
+	Net:                 0x0709110b,
+	DefaultSeeds:        []string{"localhost:3000"},
+	PowLimitBits:        0x1f100000,
+	TargetBlockInterval: 10 * time.Second,
+	RetargetInterval:    10,
+	MaxRetargetFactor:   4,
+	MaxTimeDrift:        10 * time.Minute,
+
+	InitialSubsidy:         10,
+	SubsidyHalvingInterval: 150,
+	CoinbaseMaturity:       10,
+
+	MaxBlockSize:   100000,
+	MaxBlockSigOps: 2000,
+}
+
+// activeNetParams is the network this process runs on, chosen by the CLI
+var activeNetParams = &MainNetParams
+
+// netParamsByName looks up the params of a network by its name
+func netParamsByName(name string) (*NetParams, bool) {
+	for _, params := range []*NetParams{&MainNetParams, &TestNetParams} {
+		if params.Name == name {
+			return params, true
+		}
+	}
+	return nil, false
+}
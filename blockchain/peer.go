@@ -0,0 +1,256 @@
+package blockchain
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// sendQueueSize is how many outgoing messages may wait for a slow peer
+// before it is dropped
+const sendQueueSize = 64
+
+const (
+	// pingInterval is how often a peer is pinged
+	pingInterval = 30 * time.Second
+	// pingTimeout is how long a ping may go unanswered before the peer is
+	// considered dead
+	pingTimeout = time.Minute
+)
+
+type outMessage struct {
+	command string
+	payload []byte
+}
+
+// Peer is a long-lived, bidirectional connection to another node. Messages
+// are read and written by separate goroutines so a slow write never stalls
+// message handling.
+type Peer struct {
+	manager *PeerManager
+	conn    net.Conn
+	addr    string
+	inbound bool
+	// host is the remote IP
+	host string
+	// listenAddr is where an inbound peer accepts connections, learned
+	// from its version message
+	listenAddr string
+	// services are the service flags from the version message
+	services uint64
+
+	// banScore is guarded by the manager's lock
+	banScore int
+	// addrRequested is set while our getaddr to the peer is unanswered and
+	// addrAnswered once we answered its getaddr, both guarded by the
+	// manager's lock
+	addrRequested bool
+	addrAnswered  bool
+
+	sendQueue chan outMessage
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	invLock sync.Mutex
+	// knownInventory holds the blocks and transactions the peer is known
+	// to have, invQueue the transactions to announce at the next trickle
+	knownInventory *inventorySet
+	invQueue       [][]byte
+
+	pingLock sync.Mutex
+	// pingNonce is the nonce of the unanswered ping, 0 when there is none
+	pingNonce uint64
+	pingSent  time.Time
+	// latency is the round trip time of the last answered ping
+	latency time.Duration
+}
+
+func newPeer(manager *PeerManager, conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		manager:   manager,
+		conn:      conn,
+		addr:      addr,
+		host:      hostOf(conn.RemoteAddr().String()),
+		inbound:   inbound,
+		sendQueue: make(chan outMessage, sendQueueSize),
+		quit:      make(chan struct{}),
+
+		knownInventory: newInventorySet(maxKnownInventory),
+	}
+}
+
+// Addr returns the address the peer is known by
+func (p *Peer) Addr() string {
+	return p.addr
+}
+
+func (p *Peer) String() string {
+	direction := "outbound"
+	if p.inbound {
+		direction = "inbound"
+	}
+	return p.addr + " (" + direction + ")"
+}
+
+// Start runs the peer's read, write and ping loops
+func (p *Peer) Start(bc *BlockChain) {
+	go p.readLoop(bc)
+	go p.writeLoop()
+	go p.pingLoop()
+	go p.trickleLoop()
+}
+
+// Latency returns the round trip time of the last answered ping, or 0
+// before the first pong
+func (p *Peer) Latency() time.Duration {
+	p.pingLock.Lock()
+	defer p.pingLock.Unlock()
+	return p.latency
+}
+
+// pingLoop pings the peer right away, so its latency is known early, and
+// then every pingInterval. A peer that leaves a ping unanswered for
+// pingTimeout is disconnected.
+func (p *Peer) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		p.pingLock.Lock()
+		outstanding := p.pingNonce != 0
+		waited := time.Since(p.pingSent)
+		p.pingLock.Unlock()
+
+		if outstanding && waited > pingTimeout {
+			log.Printf("%s did not answer ping within %s\n", p, pingTimeout)
+			p.Disconnect()
+			return
+		}
+		if !outstanding {
+			p.ping()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *Peer) ping() {
+	nonce := rand.Uint64()
+	for nonce == 0 {
+		nonce = rand.Uint64()
+	}
+
+	p.pingLock.Lock()
+	p.pingNonce = nonce
+	p.pingSent = time.Now()
+	p.pingLock.Unlock()
+
+	p.Send("ping", ping{nonce})
+}
+
+// handlePong records the latency when nonce answers the outstanding ping
+func (p *Peer) handlePong(nonce uint64) {
+	p.pingLock.Lock()
+	defer p.pingLock.Unlock()
+
+	if nonce == 0 || nonce != p.pingNonce {
+		log.Printf("Ignoring pong with unexpected nonce from %s\n", p)
+		return
+	}
+	p.latency = time.Since(p.pingSent)
+	p.pingNonce = 0
+}
+
+// Send queues a message for the peer, gob-encoding data as its payload
+func (p *Peer) Send(command string, data interface{}) {
+	select {
+	case p.sendQueue <- outMessage{command, gobEncode(data)}:
+	case <-p.quit:
+	default:
+		// callers may hold locks that disconnecting takes
+		log.Printf("Send queue of %s is full, disconnecting\n", p)
+		go p.Disconnect()
+	}
+}
+
+// sendWait queues a message like Send but waits for room in the queue
+// instead of dropping the peer. It is for answers to the peer's own
+// requests, which may be larger than the queue: waiting here stops
+// reading from the peer until it catches up.
+func (p *Peer) sendWait(command string, data interface{}) {
+	select {
+	case p.sendQueue <- outMessage{command, gobEncode(data)}:
+	case <-p.quit:
+	}
+}
+
+// Disconnect closes the connection and stops both loops
+func (p *Peer) Disconnect() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+		p.manager.removePeer(p)
+		syncManager.PeerDisconnected(p)
+		txRequests.peerDisconnected(p)
+		mempool.RemovePeerOrphans(p)
+		log.Printf("Disconnected from %s\n", p)
+	})
+}
+
+// Done is closed once the peer is disconnected
+func (p *Peer) Done() <-chan struct{} {
+	return p.quit
+}
+
+func (p *Peer) readLoop(bc *BlockChain) {
+	defer p.Disconnect()
+	for {
+		command, payload, err := readMessage(p.conn)
+		if errors.Is(err, ErrBadChecksum) || errors.Is(err, ErrPayloadTooLarge) || errors.Is(err, ErrBadCommand) {
+			p.manager.Misbehaving(p, banScoreMalformedMessage, err.Error())
+			return
+		}
+		if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				log.Printf("Dropping %s: %v\n", p, err)
+			}
+			return
+		}
+		log.Printf("Received command %s from %s\n", command, p)
+
+		err = handleMessage(p, command, payload, bc)
+		if err != nil {
+			p.manager.Misbehaving(p, banScoreMalformedMessage, command+": "+err.Error())
+			return
+		}
+	}
+}
+
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.sendQueue:
+			err := writeMessage(p.conn, msg.command, msg.payload)
+			if err != nil {
+				select {
+				case <-p.quit:
+				default:
+					log.Printf("Write to %s failed: %v\n", p, err)
+					p.Disconnect()
+				}
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
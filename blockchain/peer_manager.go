@@ -0,0 +1,415 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/boltdb/bolt"
+	"log"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const peersBucket = "peers"
+
+// addrKeyKey is where the secret key of the address tables is kept in the
+// peers bucket, so addresses land in the same buckets after a restart
+const addrKeyKey = "k"
+
+const (
+	defaultMaxOutbound = 8
+	defaultMaxInbound  = 32
+
+	// connectInterval is how often the manager tops up outbound connections
+	connectInterval = 5 * time.Second
+	// dialTimeout bounds a single connection attempt
+	dialTimeout = 5 * time.Second
+	// baseRetryDelay is the wait after the first failed attempt, doubled
+	// after every further failure up to maxRetryDelay
+	baseRetryDelay = 5 * time.Second
+	maxRetryDelay  = 30 * time.Minute
+)
+
+var ErrSelfConnect = errors.New("refusing to connect to ourselves")
+
+// PeerManager owns every connection of the node. It keeps outbound
+// connections topped up from the address book, retrying unreachable
+// addresses with exponential backoff, and caps inbound and outbound peers
+// separately.
+type PeerManager struct {
+	bc          *BlockChain
+	maxOutbound int
+	maxInbound  int
+
+	mu       sync.Mutex
+	outbound map[string]*Peer
+	inbound  map[string]*Peer
+	dialing  map[string]bool
+	addrs    *addrManager
+	bans     map[string]*banEntry
+}
+
+// NewPeerManager creates a manager for bc, loading the address book from
+// the database and adding seeds to it
+func NewPeerManager(bc *BlockChain, seeds []string) *PeerManager {
+	pm := &PeerManager{
+		bc:          bc,
+		maxOutbound: defaultMaxOutbound,
+		maxInbound:  defaultMaxInbound,
+		outbound:    make(map[string]*Peer),
+		inbound:     make(map[string]*Peer),
+		dialing:     make(map[string]bool),
+		bans:        make(map[string]*banEntry),
+	}
+
+	var evicted []string
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bansBucket))
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(peersBucket))
+		if err != nil {
+			return err
+		}
+
+		key := b.Get([]byte(addrKeyKey))
+		if key == nil {
+			key = make([]byte, 32)
+			_, err = rand.Read(key)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(addrKeyKey), key)
+			if err != nil {
+				return err
+			}
+		}
+		pm.addrs = newAddrManager(append([]byte(nil), key...))
+
+		return b.ForEach(func(k, v []byte) error {
+			if string(k) == addrKeyKey {
+				return nil
+			}
+			evicted = append(evicted, pm.addrs.load(deserializeKnownAddress(v))...)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	pm.saveAddresses(nil, evicted)
+	for _, ban := range loadBans(bc.Db) {
+		pm.bans[ban.Host] = ban
+	}
+
+	var seedAddrs []netAddress
+	for _, seed := range seeds {
+		seedAddrs = append(seedAddrs, newNetAddress(seed, SFNodeNetwork))
+	}
+	pm.AddAddresses(seedAddrs, "")
+	return pm
+}
+
+// Start keeps outbound connections topped up until the process exits
+func (pm *PeerManager) Start() {
+	go func() {
+		for {
+			pm.fillOutbound()
+			time.Sleep(connectInterval)
+		}
+	}()
+}
+
+// AddAddresses adds addresses heard of from source to the address book and
+// returns the ones that were new. An empty source means we found them
+// ourselves.
+func (pm *PeerManager) AddAddresses(addrs []netAddress, source string) []netAddress {
+	pm.mu.Lock()
+	var added []netAddress
+	var changed []*knownAddress
+	var evicted []string
+	for _, na := range addrs {
+		if na.Addr == "" || isOwnAddr(na.Addr) {
+			continue
+		}
+		ka, isNew, dropped := pm.addrs.add(na, source)
+		evicted = append(evicted, dropped...)
+		if ka == nil {
+			continue
+		}
+		changed = append(changed, ka)
+		if isNew {
+			added = append(added, ka.netAddress())
+		}
+	}
+	saved := copyAddresses(changed)
+	pm.mu.Unlock()
+
+	pm.saveAddresses(saved, evicted)
+	return added
+}
+
+// AddressSample returns a random part of the address book, at most max
+// addresses, to answer a getaddr
+func (pm *PeerManager) AddressSample(max int) []netAddress {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.addrs.sample(max)
+}
+
+// AddressCount returns the number of addresses in the address book
+func (pm *PeerManager) AddressCount() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return len(pm.addrs.addresses)
+}
+
+// RelayAddresses passes addresses announced by from on to a few random
+// peers, so new nodes become known without flooding the network
+func (pm *PeerManager) RelayAddresses(from *Peer, addrs []netAddress) {
+	var targets []*Peer
+	for _, p := range pm.Peers() {
+		if p != from {
+			targets = append(targets, p)
+		}
+	}
+	mrand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > addrRelayFanout {
+		targets = targets[:addrRelayFanout]
+	}
+	for _, p := range targets {
+		sendAddr(p, addrs)
+	}
+}
+
+// addrResponse reports whether an addr message from p answers our getaddr
+func (pm *PeerManager) addrResponse(p *Peer) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	response := p.addrRequested
+	p.addrRequested = false
+	return response
+}
+
+// answerGetAddr reports whether a getaddr from p should be answered, which
+// is only the case once per connection
+func (pm *PeerManager) answerGetAddr(p *Peer) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if p.addrAnswered {
+		return false
+	}
+	p.addrAnswered = true
+	return true
+}
+
+// Peers returns every connected peer
+func (pm *PeerManager) Peers() []*Peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var peers []*Peer
+	for _, p := range pm.outbound {
+		peers = append(peers, p)
+	}
+	for _, p := range pm.inbound {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// AddInbound takes over an accepted connection, closing it when the
+// inbound limit is reached, its host is banned or the encrypted handshake
+// fails. It blocks during the handshake.
+func (pm *PeerManager) AddInbound(conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	if pm.IsBanned(banKey(addr)) {
+		log.Printf("Rejecting %s: %v\n", addr, ErrBanned)
+		conn.Close()
+		return
+	}
+	secure, err := setupTransport(conn, false)
+	if err != nil {
+		log.Printf("Handshake with %s failed: %v\n", addr, err)
+		conn.Close()
+		return
+	}
+	p := newPeer(pm, secure, addr, true)
+
+	pm.mu.Lock()
+	if len(pm.inbound) >= pm.maxInbound {
+		pm.mu.Unlock()
+		log.Printf("Rejecting %s: inbound connection limit reached\n", p)
+		secure.Close()
+		return
+	}
+	pm.inbound[p.addr] = p
+	pm.mu.Unlock()
+
+	log.Printf("Accepted %s\n", p)
+	p.Start(pm.bc)
+}
+
+// setListenAddr records the address an inbound peer accepts connections
+// on, as announced in its version message. It is not added to the address
+// book here: the peer advertises it in an addr message, which is relayed.
+// It fails with ErrBanned for a local peer banned under that address,
+// whose connection could not be told apart before.
+func (pm *PeerManager) setListenAddr(p *Peer, addr string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	p.listenAddr = addr
+	if addr != "" && pm.isBanned(banKey(addr)) {
+		return ErrBanned
+	}
+	return nil
+}
+
+// fillOutbound dials addresses whose backoff has passed until the
+// outbound limit is reached
+func (pm *PeerManager) fillOutbound() {
+	now := time.Now()
+
+	pm.mu.Lock()
+	// nodes that already connected to us are not dialed back
+	connected := make(map[string]bool)
+	for _, p := range pm.inbound {
+		connected[p.listenAddr] = true
+	}
+	for addr := range pm.outbound {
+		connected[addr] = true
+	}
+
+	free := pm.maxOutbound - len(pm.outbound) - len(pm.dialing)
+	candidates := pm.addrs.dialCandidates(func(ka *knownAddress) bool {
+		if connected[ka.Addr] || pm.dialing[ka.Addr] || isOwnAddr(ka.Addr) || pm.isBanned(banKey(ka.Addr)) {
+			return true
+		}
+		return now.Before(time.Unix(ka.LastAttempt, 0).Add(ka.retryDelay()))
+	})
+	if len(candidates) > free {
+		candidates = candidates[:max(free, 0)]
+	}
+	for _, addr := range candidates {
+		pm.dialing[addr] = true
+	}
+	pm.mu.Unlock()
+
+	for _, addr := range candidates {
+		go pm.dial(addr)
+	}
+}
+
+// dial connects to addr, which the caller has already marked as dialing,
+// and records the outcome in the address book
+func (pm *PeerManager) dial(addr string) (*Peer, error) {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err == nil && pm.IsBanned(banKey(conn.RemoteAddr().String())) {
+		conn.Close()
+		err = ErrBanned
+	}
+	if err == nil {
+		var secure net.Conn
+		secure, err = setupTransport(conn, true)
+		if err != nil {
+			log.Printf("Handshake with %s failed: %v\n", addr, err)
+			conn.Close()
+		}
+		conn = secure
+	}
+
+	pm.mu.Lock()
+	delete(pm.dialing, addr)
+	if err != nil {
+		saved := copyAddresses([]*knownAddress{pm.addrs.markAttempt(addr)})
+		pm.mu.Unlock()
+
+		if len(saved) > 0 {
+			log.Printf("%s is not available, retrying in %s\n", addr, saved[0].retryDelay())
+		}
+		pm.saveAddresses(saved, nil)
+		return nil, err
+	}
+	changed, evicted := pm.addrs.markGood(addr)
+	saved := copyAddresses(changed)
+
+	p := newPeer(pm, conn, addr, false)
+	p.addrRequested = true
+	pm.outbound[addr] = p
+	pm.mu.Unlock()
+
+	pm.saveAddresses(saved, evicted)
+	p.Start(pm.bc)
+	log.Printf("Connected to %s\n", p)
+	sendVersion(p, pm.bc)
+	// advertise ourselves and ask for the addresses the peer knows
+	if advertisedAddress != "" {
+		sendAddr(p, []netAddress{newNetAddress(advertisedAddress, SFNodeNetwork)})
+	}
+	sendGetAddr(p)
+	return p, nil
+}
+
+// removePeer forgets p once it is disconnected. A dropped outbound peer
+// counts as a failed attempt, so fillOutbound dials it again after backoff.
+func (pm *PeerManager) removePeer(p *Peer) {
+	pm.mu.Lock()
+	if p.inbound {
+		if pm.inbound[p.addr] == p {
+			delete(pm.inbound, p.addr)
+		}
+		pm.mu.Unlock()
+		return
+	}
+	if pm.outbound[p.addr] != p {
+		pm.mu.Unlock()
+		return
+	}
+	delete(pm.outbound, p.addr)
+	saved := copyAddresses([]*knownAddress{pm.addrs.markAttempt(p.addr)})
+	pm.mu.Unlock()
+
+	pm.saveAddresses(saved, nil)
+}
+
+// copyAddresses copies address book entries, skipping nil ones, so they can
+// be saved once the lock is released
+func copyAddresses(entries []*knownAddress) []*knownAddress {
+	var copies []*knownAddress
+	for _, ka := range entries {
+		if ka != nil {
+			c := *ka
+			copies = append(copies, &c)
+		}
+	}
+	return copies
+}
+
+// saveAddresses writes changed entries of the address book and deletes the
+// evicted ones
+func (pm *PeerManager) saveAddresses(changed []*knownAddress, evicted []string) {
+	if len(changed) == 0 && len(evicted) == 0 {
+		return
+	}
+	err := pm.bc.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(peersBucket))
+		for _, addr := range evicted {
+			err := b.Delete([]byte(addr))
+			if err != nil {
+				return err
+			}
+		}
+		for _, ka := range changed {
+			err := b.Put([]byte(ka.Addr), ka.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+}
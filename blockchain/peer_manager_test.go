@@ -0,0 +1,48 @@
+package blockchain
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{1, baseRetryDelay},
+		{2, 2 * baseRetryDelay},
+		{4, 8 * baseRetryDelay},
+		{9, 256 * baseRetryDelay},
+		{10, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+	for _, test := range tests {
+		ka := &knownAddress{Attempts: test.attempts}
+		assert.Equal(t, test.delay, ka.retryDelay(), "%d attempts", test.attempts)
+	}
+}
+
+func TestPeerManagerLimits(t *testing.T) {
+	bc, _ := newTestChain(t)
+	pm := NewPeerManager(bc, nil)
+	pm.maxOutbound = 0
+	pm.maxInbound = 0
+
+	pm.AddAddresses([]netAddress{newNetAddress("10.1.0.1:3000", SFNodeNetwork)}, "")
+	assert.Equal(t, 1, pm.AddressCount())
+	pm.fillOutbound()
+	assert.Empty(t, pm.dialing, "no dial over the outbound limit")
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	pm.AddInbound(conn)
+	_, err := remote.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the connection over the limit is closed")
+	assert.Empty(t, pm.inbound)
+}
@@ -0,0 +1,77 @@
+package blockchain
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingPong(t *testing.T) {
+	p := &Peer{sendQueue: make(chan outMessage, sendQueueSize), quit: make(chan struct{})}
+	p.ping()
+	assert.Equal(t, "ping", (<-p.sendQueue).command)
+	nonce := p.pingNonce
+	p.pingSent = time.Now().Add(-time.Second)
+
+	p.handlePong(nonce + 1)
+	assert.Zero(t, p.Latency(), "a pong for another ping is ignored")
+	p.handlePong(0)
+	assert.Zero(t, p.Latency())
+
+	p.handlePong(nonce)
+	assert.InDelta(t, time.Second, p.Latency(), float64(100*time.Millisecond))
+	assert.Zero(t, p.pingNonce)
+	p.handlePong(nonce)
+	assert.InDelta(t, time.Second, p.Latency(), float64(100*time.Millisecond), "a ping is answered once")
+}
+
+func TestPingTimeout(t *testing.T) {
+	bc, _ := newTestChain(t)
+	oldMempool, oldSyncManager := mempool, syncManager
+	t.Cleanup(func() { mempool, syncManager = oldMempool, oldSyncManager })
+	mempool = NewMempool(bc)
+	syncManager = NewSyncManager(bc)
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := newPeer(NewPeerManager(bc, nil), conn, "peer:3000", false)
+	p.pingNonce = 1
+	p.pingSent = time.Now().Add(-pingTimeout - time.Second)
+
+	// waiting for the loop, not p.Done(), lets Disconnect finish with the
+	// globals before the cleanup restores them
+	stopped := make(chan struct{})
+	go func() {
+		p.pingLoop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the ping loop does not stop")
+	}
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("a peer not answering ping is not disconnected")
+	}
+}
+
+func TestDownloadCost(t *testing.T) {
+	tests := []struct {
+		latency  time.Duration
+		inFlight int
+		cost     time.Duration
+	}{
+		{0, 0, unknownLatency},
+		{0, 3, 4 * unknownLatency},
+		{50 * time.Millisecond, 0, 50 * time.Millisecond},
+		{50 * time.Millisecond, 9, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		p := &Peer{latency: test.latency}
+		assert.Equal(t, test.cost, downloadCost(p, test.inFlight), "%+v", test)
+	}
+}
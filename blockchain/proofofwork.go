@@ -9,35 +9,45 @@ import (
 	"math/big"
 )
 
-const targetBit = 16
 const maxNonce = math.MaxInt64
 
 type ProofOfWork struct {
-	block  *Block
+	header *BlockHeader
 	target *big.Int
 }
 
 func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBit))
+	return NewHeaderProofOfWork(b.Header())
+}
+
+// NewHeaderProofOfWork checks or mines the proof of work of a header, which
+// does not need the block's transactions
+func NewHeaderProofOfWork(h *BlockHeader) *ProofOfWork {
+	target := CompactToBig(h.Bits)
 	return &ProofOfWork{
-		block:  b,
+		header: h,
 		target: target,
 	}
 }
 
 func (pow *ProofOfWork) PrepareData(nonce int) []byte {
 	bytes := bytes.Join([][]byte{
-		pow.block.PreBlockHash,
-		pow.block.HashTransactions(),
-		util.IntToHex(pow.block.Timestamp),
-		util.IntToHex(int64(targetBit)),
+		pow.header.PreBlockHash,
+		pow.header.MerkleRoot,
+		util.IntToHex(pow.header.Timestamp),
+		util.IntToHex(int64(pow.header.Bits)),
 		util.IntToHex(int64(nonce)),
 	}, []byte{})
 	return bytes
 }
 
-
+// Work returns the expected number of hashes needed to meet the target,
+// 2^256 / (target+1)
+func (pow *ProofOfWork) Work() *big.Int {
+	denominator := new(big.Int).Add(pow.target, big.NewInt(1))
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, denominator)
+}
 
 func (pow *ProofOfWork) Run() (int, []byte) {
 	nonce := 0
@@ -60,8 +70,11 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 }
 
 func (pow *ProofOfWork) Validate() bool {
+	if pow.target.Sign() <= 0 || pow.target.Cmp(CompactToBig(activeNetParams.PowLimitBits)) > 0 {
+		return false
+	}
 	var hashInt big.Int
-	data := pow.PrepareData(pow.block.Nonce)
+	data := pow.PrepareData(pow.header.Nonce)
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 	if hashInt.Cmp(pow.target) == -1 {
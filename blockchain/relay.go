@@ -0,0 +1,221 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// maxInvPerMsg is the most items one inv or getdata message may carry
+	maxInvPerMsg = 1000
+	// maxKnownInventory bounds the items remembered per peer
+	maxKnownInventory = 5000
+	// transactions are announced in batches at random intervals averaging
+	// outboundTrickleInterval, or inboundTrickleInterval for inbound peers,
+	// so the timing of announcements does not reveal where a transaction
+	// came from
+	outboundTrickleInterval = 2 * time.Second
+	inboundTrickleInterval  = 5 * time.Second
+	// txRequestTimeout is how long a transaction asked from one peer is not
+	// asked from others
+	txRequestTimeout = time.Minute
+)
+
+// inventorySet remembers up to a fixed number of hashes, forgetting the
+// oldest first
+type inventorySet struct {
+	items map[string]bool
+	order []string
+	limit int
+}
+
+func newInventorySet(limit int) *inventorySet {
+	return &inventorySet{items: make(map[string]bool), limit: limit}
+}
+
+func (s *inventorySet) add(hash []byte) {
+	key := hex.EncodeToString(hash)
+	if s.items[key] {
+		return
+	}
+	if len(s.order) >= s.limit {
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.items[key] = true
+	s.order = append(s.order, key)
+}
+
+func (s *inventorySet) contains(hash []byte) bool {
+	return s.items[hex.EncodeToString(hash)]
+}
+
+// addKnownInventory records that p has the item, so it is not announced to p
+func (p *Peer) addKnownInventory(hash []byte) {
+	p.invLock.Lock()
+	defer p.invLock.Unlock()
+	p.knownInventory.add(hash)
+}
+
+// queueTxInventory schedules a transaction announcement for the next
+// trickle unless p already has it
+func (p *Peer) queueTxInventory(txID []byte) {
+	p.invLock.Lock()
+	defer p.invLock.Unlock()
+	if !p.knownInventory.contains(txID) {
+		p.invQueue = append(p.invQueue, txID)
+	}
+}
+
+// announceBlock sends a block announcement right away unless p already
+// has the block
+func (p *Peer) announceBlock(hash []byte) {
+	p.invLock.Lock()
+	known := p.knownInventory.contains(hash)
+	p.knownInventory.add(hash)
+	p.invLock.Unlock()
+
+	if !known {
+		sendInv(p, "block", [][]byte{hash})
+	}
+}
+
+// trickleLoop sends the queued transaction announcements in batches
+func (p *Peer) trickleLoop() {
+	mean := outboundTrickleInterval
+	if p.inbound {
+		mean = inboundTrickleInterval
+	}
+	for {
+		timer := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(mean)))
+		select {
+		case <-timer.C:
+		case <-p.quit:
+			timer.Stop()
+			return
+		}
+
+		p.invLock.Lock()
+		var batch [][]byte
+		for _, txID := range p.invQueue {
+			// the peer may have announced it to us in the meantime
+			if !p.knownInventory.contains(txID) {
+				p.knownInventory.add(txID)
+				batch = append(batch, txID)
+			}
+		}
+		p.invQueue = nil
+		p.invLock.Unlock()
+
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > maxInvPerMsg {
+				n = maxInvPerMsg
+			}
+			sendInv(p, "tx", batch[:n])
+			batch = batch[n:]
+		}
+	}
+}
+
+// relayTransaction announces a transaction accepted to the mempool to every
+// peer except from, which sent it
+func relayTransaction(txID []byte, from *Peer) {
+	for _, p := range peerManager.Peers() {
+		if p != from {
+			p.queueTxInventory(txID)
+		}
+	}
+}
+
+// relayBlock announces a new chain tip to every peer that does not have it
+func relayBlock(hash []byte) {
+	for _, p := range peerManager.Peers() {
+		p.announceBlock(hash)
+	}
+}
+
+type txRequest struct {
+	key  string
+	peer *Peer
+	time time.Time
+}
+
+// txRequestTracker remembers which transactions were asked for and from
+// whom, so an item announced by several peers is downloaded once
+type txRequestTracker struct {
+	mu        sync.Mutex
+	requested map[string]*txRequest
+	// byPeer indexes requested by the peer asked
+	byPeer map[*Peer]map[string]*txRequest
+	// queue lists requests oldest first so they expire without a scan.
+	// Requests answered in the meantime are skipped.
+	queue []*txRequest
+}
+
+var txRequests = newTxRequestTracker()
+
+func newTxRequestTracker() *txRequestTracker {
+	return &txRequestTracker{
+		requested: make(map[string]*txRequest),
+		byPeer:    make(map[*Peer]map[string]*txRequest),
+	}
+}
+
+// request reports whether txID should be asked from p, and if so records
+// the request
+func (t *txRequestTracker) request(p *Peer, txID []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.queue) > 0 && time.Since(t.queue[0].time) >= txRequestTimeout {
+		if req := t.queue[0]; t.requested[req.key] == req {
+			t.forget(req)
+		}
+		t.queue = t.queue[1:]
+	}
+	key := hex.EncodeToString(txID)
+	if req, ok := t.requested[key]; ok {
+		if time.Since(req.time) < txRequestTimeout {
+			return false
+		}
+		t.forget(req)
+	}
+	req := &txRequest{key, p, time.Now()}
+	t.requested[key] = req
+	if t.byPeer[p] == nil {
+		t.byPeer[p] = make(map[string]*txRequest)
+	}
+	t.byPeer[p][key] = req
+	t.queue = append(t.queue, req)
+	return true
+}
+
+func (t *txRequestTracker) forget(req *txRequest) {
+	delete(t.requested, req.key)
+	delete(t.byPeer[req.peer], req.key)
+	if len(t.byPeer[req.peer]) == 0 {
+		delete(t.byPeer, req.peer)
+	}
+}
+
+// received forgets the request for txID once it arrived
+func (t *txRequestTracker) received(txID []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if req, ok := t.requested[hex.EncodeToString(txID)]; ok {
+		t.forget(req)
+	}
+}
+
+// peerDisconnected forgets the requests made to p, so the transactions
+// can be asked from other peers right away
+func (t *txRequestTracker) peerDisconnected(p *Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, req := range t.byPeer[p] {
+		t.forget(req)
+	}
+}
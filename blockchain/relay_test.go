@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventorySet(t *testing.T) {
+	s := newInventorySet(3)
+	for i := byte(0); i < 4; i++ {
+		s.add([]byte{i})
+	}
+	s.add([]byte{3})
+	assert.False(t, s.contains([]byte{0}), "the oldest item is forgotten")
+	assert.True(t, s.contains([]byte{1}))
+	assert.True(t, s.contains([]byte{3}))
+	assert.Len(t, s.order, 3)
+}
+
+func TestTxRequestTracker(t *testing.T) {
+	tracker := newTxRequestTracker()
+	p1, p2 := &Peer{}, &Peer{}
+	txID := []byte("tx")
+
+	assert.True(t, tracker.request(p1, txID))
+	assert.False(t, tracker.request(p2, txID), "already in flight")
+
+	tracker.peerDisconnected(p1)
+	assert.True(t, tracker.request(p2, txID), "asked again when the peer is gone")
+
+	tracker.requested["7478"].time = time.Now().Add(-txRequestTimeout)
+	assert.True(t, tracker.request(p1, txID), "asked again after the timeout")
+
+	tracker.received(txID)
+	assert.Empty(t, tracker.requested)
+	assert.Empty(t, tracker.byPeer)
+}
+
+func TestTxRequestExpiry(t *testing.T) {
+	tracker := newTxRequestTracker()
+	p := &Peer{}
+	for i := 0; i < maxInvPerMsg; i++ {
+		assert.True(t, tracker.request(p, []byte{byte(i >> 8), byte(i)}))
+	}
+	for _, req := range tracker.queue {
+		req.time = time.Now().Add(-txRequestTimeout)
+	}
+
+	// the next request expires the old ones from the front of the queue
+	assert.True(t, tracker.request(p, []byte("new")))
+	assert.Len(t, tracker.requested, 1)
+	assert.Len(t, tracker.queue, 1)
+	assert.Len(t, tracker.byPeer[p], 1)
+}
+
+func TestGetDataLargerThanSendQueue(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	oldMempool := mempool
+	t.Cleanup(func() { mempool = oldMempool })
+	mempool = NewMempool(bc)
+
+	n := 2 * sendQueueSize
+	funds := fundOutputs(t, bc, wallet, n)
+	var items [][]byte
+	for vout := range funds.Vout {
+		spend := spendOutput(wallet, funds, vout, 0)
+		assert.NoError(t, mempool.Add(spend))
+		items = append(items, spend.ID)
+	}
+
+	p := &Peer{sendQueue: make(chan outMessage, sendQueueSize), quit: make(chan struct{}), knownInventory: newInventorySet(maxKnownInventory)}
+	done := make(chan error)
+	go func() {
+		done <- handleGetData(p, gobEncode(getdata{"tx", items}), bc)
+	}()
+
+	// the answer waits for the peer to drain its queue instead of dropping it
+	for i := 0; i < n; i++ {
+		assert.Equal(t, "tx", (<-p.sendQueue).command)
+	}
+	assert.NoError(t, <-done)
+	select {
+	case <-p.quit:
+		t.Fatal("the peer was disconnected")
+	default:
+	}
+}
@@ -0,0 +1,71 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+// ChainUpdate lists the blocks taken off and put on the main chain by
+// AddBlock, each in the order they were applied
+type ChainUpdate struct {
+	Disconnected []*Block
+	Connected    []*Block
+}
+
+// reorganize makes newTip the tip of the main chain. Blocks are disconnected
+// back to the fork point and the new branch is connected on top of it; any
+// error leaves it to the caller to roll back tx.
+func reorganize(tx *bolt.Tx, newTip *Block) (*ChainUpdate, error) {
+	blocks := tx.Bucket([]byte(blockBucket))
+	update := &ChainUpdate{}
+
+	parentOf := func(block *Block) (*Block, error) {
+		data := blocks.Get(block.PreBlockHash)
+		if len(block.PreBlockHash) == 0 || data == nil {
+			return nil, fmt.Errorf("block %x has no common ancestor with the main chain", block.Hash)
+		}
+		return DeSerializeBlock(data), nil
+	}
+
+	detach := DeSerializeBlock(blocks.Get(blocks.Get([]byte("l"))))
+	attach := newTip
+	var branch []*Block
+	var err error
+
+	for !bytes.Equal(detach.Hash, attach.Hash) {
+		if detach.Height >= attach.Height {
+			err = disconnectBlock(tx, detach)
+			if err != nil {
+				return nil, err
+			}
+			update.Disconnected = append(update.Disconnected, detach)
+			detach, err = parentOf(detach)
+		} else {
+			branch = append(branch, attach)
+			attach, err = parentOf(attach)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		err = connectBlock(tx, branch[i])
+		if err != nil {
+			return nil, err
+		}
+		update.Connected = append(update.Connected, branch[i])
+	}
+
+	if len(update.Disconnected) > 0 {
+		log.Printf("Reorganized: disconnected %d blocks, connected %d, fork at %x\n",
+			len(update.Disconnected), len(update.Connected), detach.Hash)
+	}
+	err = blocks.Put([]byte("l"), newTip.Hash)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return update, nil
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mineOn mines a block on parent holding txs and a coinbase paying address.
+// The block's hash sorts after worseThan's, so it loses a tie in work.
+func mineOn(parent *Block, txs []*Transaction, address string, worseThan *Block) *Block {
+	height := parent.Height + 1
+	txs = append(txs, NewCoinbaseTX(address, "", height, 0))
+	timestamp := time.Now().Unix()
+	if parent.Timestamp > timestamp {
+		timestamp = parent.Timestamp
+	}
+	for timestamp++; ; timestamp++ {
+		block := NewBlock(txs, parent.Hash, height, activeNetParams.PowLimitBits, timestamp)
+		if worseThan == nil || bytes.Compare(block.Hash, worseThan.Hash) > 0 {
+			return block
+		}
+	}
+}
+
+func TestReorgMarksFailedBranchInvalid(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+
+	main := mineOn(&genesis, nil, address, nil)
+	_, err = bc.AddBlock(main)
+	assert.NoError(t, err)
+
+	// a side-branch block is stored without checking its inputs
+	unknown := &Transaction{ID: []byte("unknown"), Vout: []TXOutput{*NewTXOutput(5, address)}}
+	bad := mineOn(&genesis, []*Transaction{spendOutput(wallet, unknown, 0, 0)}, address, main)
+	update, err := bc.AddBlock(bad)
+	assert.NoError(t, err)
+	assert.Empty(t, update.Connected)
+
+	child := mineOn(bad, nil, address, nil)
+	_, err = bc.AddBlock(child)
+	assert.ErrorIs(t, err, ErrMissingInput)
+	assert.Equal(t, main.Hash, bc.Tip())
+
+	err = bc.Db.View(func(tx *bolt.Tx) error {
+		assert.True(t, getBlockNode(tx, bad.Hash).Invalid)
+		assert.False(t, getBlockNode(tx, main.Hash).Invalid)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// the branch is rejected before a reorganization is tried again
+	_, err = bc.AddBlock(child)
+	assert.ErrorIs(t, err, ErrInvalidChain)
+	_, err = bc.AddBlock(mineOn(child, nil, address, nil))
+	assert.ErrorIs(t, err, ErrUnknownParent)
+}
+
+func blockHashes(blocks ...*Block) [][]byte {
+	var hashes [][]byte
+	for _, block := range blocks {
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes
+}
+
+// chainstate returns every entry of the UTXO set
+func chainstate(t *testing.T, bc *BlockChain) map[string]TXOutputs {
+	utxo := make(map[string]TXOutputs)
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			utxo[string(k)] = DeserializeOutputs(v)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	return utxo
+}
+
+func TestReorgConnectDisconnect(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	utxo := UTXOSet{bc}
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+
+	payee := NewWallet()
+	payment := splitOutput(wallet, genesis.Transactions[0], 0, 0, string(payee.GetAddress()), 1)
+	a1 := mineOn(&genesis, []*Transaction{payment}, address, nil)
+	_, err = bc.AddBlock(a1)
+	assert.NoError(t, err)
+	assert.Len(t, utxo.FindUTXO(HashPubKey(payee.PublicKey)), 1)
+
+	// a longer branch without the payment undoes it
+	b1 := mineOn(&genesis, nil, address, a1)
+	update, err := bc.AddBlock(b1)
+	assert.NoError(t, err)
+	assert.Empty(t, update.Connected)
+	b2 := mineOn(b1, nil, address, nil)
+	update, err = bc.AddBlock(b2)
+	assert.NoError(t, err)
+	assert.Equal(t, blockHashes(a1), blockHashes(update.Disconnected...))
+	assert.Equal(t, blockHashes(b1, b2), blockHashes(update.Connected...))
+	assert.Equal(t, b2.Hash, bc.Tip())
+	assert.Empty(t, utxo.FindUTXO(HashPubKey(payee.PublicKey)))
+	assert.Equal(t, 3*CalcBlockSubsidy(0), utxo.CirculatingSupply())
+
+	reorganized := chainstate(t, bc)
+	utxo.Reindex()
+	assert.Equal(t, chainstate(t, bc), reorganized, "undo restores what replaying the chain builds")
+
+	// and switching back redoes it
+	a2 := mineOn(a1, nil, address, nil)
+	a3 := mineOn(a2, nil, address, nil)
+	var disconnected, connected []*Block
+	for _, block := range []*Block{a2, a3} {
+		update, err = bc.AddBlock(block)
+		assert.NoError(t, err)
+		disconnected = append(disconnected, update.Disconnected...)
+		connected = append(connected, update.Connected...)
+	}
+	assert.Equal(t, blockHashes(b2, b1), blockHashes(disconnected...))
+	assert.Equal(t, blockHashes(a1, a2, a3), blockHashes(connected...))
+	assert.Equal(t, a3.Hash, bc.Tip())
+	assert.Len(t, utxo.FindUTXO(HashPubKey(payee.PublicKey)), 1)
+
+	reorganized = chainstate(t, bc)
+	utxo.Reindex()
+	assert.Equal(t, chainstate(t, bc), reorganized)
+}
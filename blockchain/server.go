@@ -3,57 +3,99 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math/big"
 	"net"
+	"time"
 )
 
 const protocol = "tcp"
 const nodeVersion = 1
 const commandLength = 12
 
-var nodeAddress string
-var miningAddress string
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit = [][]byte{}
-var mempoll = make(map[string]Transaction)
+// maxBlocksPerInv caps the hashes sent in answer to one getblocks
+const maxBlocksPerInv = 500
+
+// listenAddress is the address the node binds to and advertisedAddress
+// the one it tells peers to connect to. They differ behind NAT or in
+// containers, and advertisedAddress is empty when the node should not be
+// dialed at all.
+var listenAddress string
+var advertisedAddress string
+
+// seedNodes are the addresses a node connects to first and the CLI hands
+// transactions to
+var seedNodes []string
+var mempool *Mempool
+
+// miner is nil unless the node mines
+var miner *Miner
+var peerManager *PeerManager
+var syncManager *SyncManager
 
 type addr struct {
-	AddrList []string
+	AddrList []netAddress
 }
 
 type block struct {
-	AddrFrom string
-	Block    []byte
+	Block []byte
 }
 
+// getblocks asks for the hashes of the blocks after the last locator entry
+// on the sender's main chain, up to HashStop or maxBlocksPerInv of them
 type getblocks struct {
-	AddrFrom string
+	Locator  [][]byte
+	HashStop []byte
+}
+
+// getaddr asks for up to Max addresses from the receiver's address book
+type getaddr struct {
+	Max int
 }
 
 type getdata struct {
-	AddrFrom string
-	Type     string
-	ID       []byte
+	Type  string
+	Items [][]byte
+}
+
+type getheaders struct {
+	Locator  [][]byte
+	HashStop []byte
+}
+
+type headers struct {
+	Headers []BlockHeader
 }
 
 type inv struct {
-	AddrFrom string
-	Type     string
-	Item     [][]byte
+	Type string
+	Item [][]byte
+}
+
+type ping struct {
+	Nonce uint64
+}
+
+type pong struct {
+	Nonce uint64
 }
 
 type tx struct {
-	AddrFrom    string
 	Transaction []byte
 }
 
 type verzion struct {
 	Version    int
+	Services   uint64
 	BestHeight int
-	AddrFrom   string
+	BestWork   *big.Int
+	BestHash   []byte
+	Timestamp  int64
+	// AdvertisedAddr is where the sender accepts connections, empty when
+	// it does not
+	AdvertisedAddr string
 }
 
 func commandToBytes(command string) []byte {
@@ -78,352 +120,485 @@ func extractCommand(request []byte) []byte {
 	return request[:commandLength]
 }
 
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
+// sendDirect delivers one message to addr over a short-lived connection,
+// for CLI commands that do not run a node
+func sendDirect(addr, command string, data interface{}) error {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
+	secure, err := setupTransport(conn, true)
+	if err != nil {
+		return err
+	}
+	return writeMessage(secure, command, gobEncode(data))
 }
 
-func sendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
-	sendData(address, request)
+func sendAddr(p *Peer, addrs []netAddress) {
+	p.Send("addr", addr{addrs})
 }
 
-func sendBlock(addr string, b *Block) {
-	data := block{
-		AddrFrom: addr,
-		Block:    b.Serialize(),
-	}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
-	sendData(addr, request)
+func sendGetAddr(p *Peer) {
+	p.Send("getaddr", getaddr{maxAddrPerMsg})
 }
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-	if err != nil {
-		log.Println(addr, " is not avaliable!")
-		var updateNodes []string
-		for _, node := range knownNodes {
-			if node != addr {
-				updateNodes = append(updateNodes, node)
-			}
-		}
-		knownNodes = updateNodes
-		return
-	}
-	defer conn.Close()
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panicln(err)
-	}
+func sendBlock(p *Peer, b *Block) {
+	p.sendWait("block", block{b.Serialize()})
 }
 
-func sendInv(address, kind string, items [][]byte) {
-	inventory := inv{
-		AddrFrom: address,
-		Type:     kind,
-		Item:     items,
-	}
-	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
-	sendData(address, request)
+func sendInv(p *Peer, kind string, items [][]byte) {
+	p.Send("inv", inv{kind, items})
 }
 
-func sendGetBlocks(address string) {
-	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
-	sendData(address, request)
+func sendGetBlocks(p *Peer, locator [][]byte, hashStop []byte) {
+	p.Send("getblocks", getblocks{locator, hashStop})
 }
 
-func sendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getdata{address, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
-	sendData(address, request)
+func sendGetHeaders(p *Peer, locator [][]byte, hashStop []byte) {
+	p.Send("getheaders", getheaders{locator, hashStop})
 }
 
-func sendTx(address string, tnx *Transaction) {
-	data := tx{
-		AddrFrom:    address,
-		Transaction: tnx.Serialize(),
-	}
-	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
-	sendData(address, request)
+func sendHeaders(p *Peer, blockHeaders []BlockHeader) {
+	p.Send("headers", headers{blockHeaders})
 }
 
-func sendVersion(addr string, bc *BlockChain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress})
-	request := append(commandToBytes("version"), payload...)
-	sendData(addr, request)
+func sendGetData(p *Peer, kind string, items [][]byte) {
+	p.Send("getdata", getdata{kind, items})
 }
 
-func handleAddr(request []byte) {
-	var buff bytes.Buffer
+func sendTx(p *Peer, tnx *Transaction) {
+	p.sendWait("tx", tx{tnx.Serialize()})
+}
+
+// submitTx hands a transaction created by the CLI to the node at addr
+func submitTx(addr string, tnx *Transaction) error {
+	return sendDirect(addr, "tx", tx{tnx.Serialize()})
+}
+
+func sendVersion(p *Peer, bc *BlockChain) {
+	best := bc.bestNode()
+	p.Send("version", verzion{nodeVersion, SFNodeNetwork, best.Height, best.ChainWork, best.Hash, time.Now().Unix(), advertisedAddress})
+}
+
+func handleAddr(p *Peer, request []byte, bc *BlockChain) error {
 	var payload addr
-	buff.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buff)
-	err := decoder.Decode(&payload)
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	log.Printf("There are %d known nodes now~\n", len(knownNodes))
-	requestBlocks()
+	if len(payload.AddrList) > maxAddrPerMsg {
+		peerManager.Misbehaving(p, banScoreOversizedMessage, fmt.Sprintf("%d addresses in one addr message", len(payload.AddrList)))
+		return nil
+	}
+
+	response := peerManager.addrResponse(p)
+	added := peerManager.AddAddresses(payload.AddrList, p.host)
+	log.Printf("There are %d known nodes now~\n", peerManager.AddressCount())
+
+	// answers to getaddr are not passed on, only small announcements of
+	// nodes that were online recently
+	if response || len(payload.AddrList) > maxAddrToRelay {
+		return nil
+	}
+	var fresh []netAddress
+	cutoff := time.Now().Add(-addrRelayAge).Unix()
+	for _, na := range added {
+		if na.Timestamp >= cutoff {
+			fresh = append(fresh, na)
+		}
+	}
+	if len(fresh) > 0 {
+		peerManager.RelayAddresses(p, fresh)
+	}
+	return nil
 }
 
-func handleBlock(request []byte, bc *BlockChain) {
-	var buff bytes.Buffer
-	var payload block
-	buff.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buff)
-	err := decoder.Decode(&payload)
+// handleGetAddr answers the first getaddr of an inbound peer with a random
+// sample of the address book. Outbound peers are not answered, so a node
+// we connect to cannot map what we know.
+func handleGetAddr(p *Peer, request []byte, bc *BlockChain) error {
+	var payload getaddr
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
-
-	block := DeSerializeBlock(payload.Block)
-	log.Println("Received a new block")
-	bc.AddBlock(block)
-	log.Printf("Added block, hash:%x\n", block.Hash)
-
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-//TODO pre block may not exist
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+	if !p.inbound || !peerManager.answerGetAddr(p) {
+		return nil
 	}
+	max := payload.Max
+	if max <= 0 || max > maxAddrPerMsg {
+		max = maxAddrPerMsg
+	}
+	sendAddr(p, peerManager.AddressSample(max))
+	return nil
 }
 
-func handleGetBlock(request []byte, bc *BlockChain) {
-	var buf bytes.Buffer
+func handleBlock(p *Peer, request []byte, bc *BlockChain) error {
 	var payload block
-
-	buf.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buf)
-	err := decoder.Decode(&payload)
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
 
-	blockData := payload.Block
-	block := DeSerialize(blockData)
-
+	if len(payload.Block) > activeNetParams.MaxBlockSize {
+		return fmt.Errorf("block of %d bytes is over the size limit", len(payload.Block))
+	}
+	block := &Block{}
+	err = gobDecode(payload.Block, block)
+	if err != nil {
+		return err
+	}
 	log.Println("Received a new block")
-	bc.AddBlock(block)
-	log.Printf("Added block %x\n", block.Hash)
+	p.addKnownInventory(block.Hash)
+	if syncManager.HandleBlock(p, block) {
+		return nil
+	}
+	update, err := bc.AddBlock(block)
+	if err != nil {
+		log.Println(err)
+		var rejectErr *BlockRejectError
+		if errors.As(err, &rejectErr) && blockIsPunishable(rejectErr) {
+			peerManager.Misbehaving(p, banScoreInvalidBlock, err.Error())
+		}
+		return nil
+	}
+	log.Printf("Added block, hash:%x\n", block.Hash)
+	applyChainUpdate(update)
+	if len(update.Connected) > 0 {
+		relayBlock(update.Connected[len(update.Connected)-1].Hash)
+	}
+	return nil
+}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	} else { // TODO
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+// applyChainUpdate brings the mempool in line with a changed main chain and
+// relays the orphans the new blocks made valid
+func applyChainUpdate(update *ChainUpdate) {
+	for _, tx := range mempool.ApplyChainUpdate(update) {
+		relayTransaction(tx.ID, nil)
 	}
 }
 
-func handleInv(request []byte, bc *BlockChain) {
-	var buf bytes.Buffer
-	var payload inv
+// blockIsPunishable reports whether a peer sending a block rejected for err
+// broke the rules. A missing parent or a clock ahead of ours can happen to
+// honest peers.
+func blockIsPunishable(err *BlockRejectError) bool {
+	return err.Reason != ErrUnknownParent && err.Reason != ErrTimeTooNew
+}
 
-	buf.Write(request)
-	decoder := gob.NewDecoder(&buf)
-	err := decoder.Decode(&payload)
+func handleInv(p *Peer, request []byte, bc *BlockChain) error {
+	var payload inv
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
 
-	log.Printf("Received inventory with %d %s", len(payload.Item), payload.Type)
+	log.Printf("Received inventory with %d %s\n", len(payload.Item), payload.Type)
+	if len(payload.Item) > maxInvPerMsg {
+		peerManager.Misbehaving(p, banScoreOversizedMessage, fmt.Sprintf("%d items in one inv message", len(payload.Item)))
+		return nil
+	}
+	for _, hash := range payload.Item {
+		p.addKnownInventory(hash)
+	}
 
 	if payload.Type == "block" {
-		blocksInTransit := payload.Item
-		blockHash := payload.Item[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		for _, hash := range payload.Item {
+			if _, err := bc.GetBlock(hash); err != nil {
+				syncManager.RequestHeaders(p)
+				break
 			}
 		}
-		blocksInTransit = newInTransit
 	}
 	if payload.Type == "tx" {
-		txID := payload.Item[0]
-		if mempoll[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		var wanted [][]byte
+		for _, txID := range payload.Item {
+			if mempool.Has(txID) {
+				continue
+			}
+			if txRequests.request(p, txID) {
+				wanted = append(wanted, txID)
+			}
+		}
+		if len(wanted) > 0 {
+			sendGetData(p, "tx", wanted)
 		}
 	}
+	return nil
 }
 
-func handleGetBlocks(request []byte, bc *BlockChain) {
-	var buf bytes.Buffer
+func handleGetBlocks(p *Peer, request []byte, bc *BlockChain) error {
 	var payload getblocks
-	buf.Write(request)
-	decoder := gob.NewDecoder(&buf)
-	err := decoder.Decode(&payload)
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
+	}
+	hashes := bc.LocateBlocks(payload.Locator, payload.HashStop, maxBlocksPerInv)
+	if len(hashes) > 0 {
+		sendInv(p, "block", hashes)
 	}
-	hashes := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", hashes)
+	return nil
 }
 
-func handleGetData(request []byte, bc *BlockChain) {
-	var buff bytes.Buffer
-	var payload getdata
-	buff.Write(request)
-	decoder := gob.NewDecoder(&buff)
-	err := decoder.Decode(&payload)
+func handleGetHeaders(p *Peer, request []byte, bc *BlockChain) error {
+	var payload getheaders
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
-	}
-
-	if payload.Type == "block" {
-		block, err := bc.GetBlock([]byte(payload.ID))
-		if err != nil {
-			return
-		}
-		sendBlock(payload.AddrFrom, &block)
+		return err
 	}
 
-	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempoll[txID]
-		sendTx(payload.AddrFrom, &tx)
+	blockHeaders, err := bc.LocateHeaders(payload.Locator, payload.HashStop, maxHeadersPerMsg)
+	if err != nil {
+		// the fault is ours, so the peer is not punished
+		log.Printf("Not answering getheaders from %s: %v\n", p, err)
+		return nil
 	}
+	sendHeaders(p, blockHeaders)
+	return nil
 }
 
-func handleTx(request []byte, bc *BlockChain) {
-	var buff bytes.Buffer
-	var payload tx
-
-	buff.Write(request)
-	decoder := gob.NewDecoder(&buff)
-	err := decoder.Decode(&payload)
+func handleHeaders(p *Peer, request []byte, bc *BlockChain) error {
+	var payload headers
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
-	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempoll[hex.EncodeToString(tx.ID)] = tx
 
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
+	log.Printf("Received %d headers\n", len(payload.Headers))
+	err = syncManager.HandleHeaders(p, payload.Headers)
+	var rejectErr *BlockRejectError
+	if errors.As(err, &rejectErr) {
+		log.Println(err)
+		if blockIsPunishable(rejectErr) {
+			peerManager.Misbehaving(p, banScoreInvalidBlock, err.Error())
 		}
-	} else {
-		if len(mempoll) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-			for _, tx := range mempoll {
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
-
-			if len(txs) == 0 {
-				log.Println("All transactions are invalid, waiting for new ones")
-				return
-			}
-
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+		return nil
+	}
+	return err
+}
 
-			newblock := bc.MineBLock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
+func handleGetData(p *Peer, request []byte, bc *BlockChain) error {
+	var payload getdata
+	err := gobDecode(request, &payload)
+	if err != nil {
+		return err
+	}
 
-			log.Println("New block is mined")
-			for _, tx := range txs {
-				delete(mempoll, hex.EncodeToString(tx.ID))
-			}
+	if len(payload.Items) > maxInvPerMsg {
+		peerManager.Misbehaving(p, banScoreOversizedMessage, fmt.Sprintf("%d items in one getdata message", len(payload.Items)))
+		return nil
+	}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newblock.Hash})
-				}
+	// items we do not have are skipped, the peer asks someone else once
+	// its request times out
+	for _, id := range payload.Items {
+		if payload.Type == "block" {
+			block, err := bc.GetBlock(id)
+			if err != nil {
+				continue
 			}
-
-			if len(mempoll) > 0 {
-				goto MineTransactions
+			p.addKnownInventory(id)
+			sendBlock(p, &block)
+		}
+		if payload.Type == "tx" {
+			tx, ok := mempool.Get(id)
+			if !ok {
+				continue
 			}
+			p.addKnownInventory(id)
+			sendTx(p, tx)
 		}
 	}
+	return nil
 }
 
-func handleVersion(request []byte, bc *BlockChain) {
-	var buff bytes.Buffer
-	var payload verzion
+func handlePing(p *Peer, request []byte, bc *BlockChain) error {
+	var payload ping
+	err := gobDecode(request, &payload)
+	if err != nil {
+		return err
+	}
+	p.Send("pong", pong{payload.Nonce})
+	return nil
+}
 
-	buff.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buff)
-	err := decoder.Decode(&payload)
+func handlePong(p *Peer, request []byte, bc *BlockChain) error {
+	var payload pong
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
+	}
+	p.handlePong(payload.Nonce)
+	return nil
+}
+
+func handleTx(p *Peer, request []byte, bc *BlockChain) error {
+	var payload tx
+	err := gobDecode(request, &payload)
+	if err != nil {
+		return err
+	}
+	var tx Transaction
+	err = gobDecode(payload.Transaction, &tx)
+	if err != nil {
+		return err
+	}
+	p.addKnownInventory(tx.ID)
+	txRequests.received(tx.ID)
+	if mempool.Has(tx.ID) {
+		return nil
 	}
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
-	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+	accepted, err := mempool.ProcessTransaction(&tx, p)
+	if errors.Is(err, ErrOrphanTransaction) {
+		log.Printf("Holding orphan transaction %x until its parents arrive\n", tx.ID)
+		var wanted [][]byte
+		for _, parentID := range mempool.MissingParents(&tx) {
+			if txRequests.request(p, parentID) {
+				wanted = append(wanted, parentID)
+			}
+		}
+		if len(wanted) > 0 {
+			sendGetData(p, "tx", wanted)
+		}
+		return nil
 	}
+	if err != nil {
+		log.Println(err)
+		var rejectErr *TxRejectError
+		if errors.As(err, &rejectErr) && txIsPunishable(rejectErr) {
+			peerManager.Misbehaving(p, banScoreInvalidTx, err.Error())
+		}
+		return nil
+	}
+	relayTransaction(tx.ID, p)
+	for _, orphan := range accepted[1:] {
+		relayTransaction(orphan.ID, nil)
+	}
+
+	if miner != nil {
+		miner.Notify()
+	}
+	return nil
 }
 
-func handleConnection(conn net.Conn, bc *BlockChain) {
-	request, err := io.ReadAll(conn)
+func handleVersion(p *Peer, request []byte, bc *BlockChain) error {
+	var payload verzion
+	err := gobDecode(request, &payload)
 	if err != nil {
-		log.Panicln(err)
+		return err
+	}
+	if p.inbound {
+		err = peerManager.setListenAddr(p, payload.AdvertisedAddr)
+		if err != nil {
+			log.Printf("Dropping %s: %v\n", p, err)
+			p.Disconnect()
+			return nil
+		}
+	}
+	if payload.Timestamp != 0 {
+		timeSource.AddTimeSample(p.host, payload.Timestamp)
 	}
+	p.services = payload.Services
 
-	command := bytesToCommand(request[:commandLength])
-	log.Println("Received command:", command)
+	myBest := bc.bestNode()
+	foreignerBest := &blockNode{
+		Hash:      payload.BestHash,
+		Height:    payload.BestHeight,
+		ChainWork: payload.BestWork,
+	}
+	if foreignerBest.ChainWork == nil {
+		foreignerBest.ChainWork = new(big.Int)
+	}
+	syncManager.PeerVersion(p, foreignerBest)
+	if myBest.betterThan(foreignerBest) {
+		sendVersion(p, bc)
+	}
+	return nil
+}
 
+// handleMessage dispatches a message from p. A returned error means the
+// peer broke the protocol and is disconnected.
+func handleMessage(p *Peer, command string, request []byte, bc *BlockChain) error {
 	switch command {
 	case "addr":
-		handleAddr(request)
+		return handleAddr(p, request, bc)
 	case "block":
-		handleBlock(request, bc)
+		return handleBlock(p, request, bc)
 	case "inv":
-		handleInv(request, bc)
+		return handleInv(p, request, bc)
+	case "getaddr":
+		return handleGetAddr(p, request, bc)
 	case "getblocks":
-		handleGetBlock(request, bc)
+		return handleGetBlocks(p, request, bc)
 	case "getdata":
-		handleGetData(request, bc)
+		return handleGetData(p, request, bc)
+	case "getheaders":
+		return handleGetHeaders(p, request, bc)
+	case "headers":
+		return handleHeaders(p, request, bc)
+	case "ping":
+		return handlePing(p, request, bc)
+	case "pong":
+		return handlePong(p, request, bc)
 	case "tx":
-		handleTx(request, bc)
+		return handleTx(p, request, bc)
 	case "version":
-		handleVersion(request, bc)
+		return handleVersion(p, request, bc)
 	default:
 		log.Println("Unknown command!")
 	}
-	conn.Close()
+	return nil
 }
 
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	miningAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
+// defaultListenAddr is where a node binds when no address is configured
+func defaultListenAddr(nodeID string) string {
+	return fmt.Sprintf("localhost:%s", nodeID)
+}
+
+// defaultAdvertisedAddr is the address advertised for listenAddr when none
+// is configured. A wildcard bind has no address peers could dial, so none
+// is advertised.
+func defaultAdvertisedAddr(listenAddr string) string {
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		return ""
+	}
+	return listenAddr
+}
+
+// isOwnAddr reports whether addr is the address this node listens on or
+// advertises, so it never dials itself
+func isOwnAddr(addr string) bool {
+	return addr == listenAddress || (advertisedAddress != "" && addr == advertisedAddress)
+}
+
+// StartServer runs the node with its database and wallet named by nodeID,
+// accepting connections on listenAddr and telling peers to dial
+// advertisedAddr
+func StartServer(nodeID, listenAddr, advertisedAddr, minerAddress string) {
+	listenAddress = listenAddr
+	advertisedAddress = advertisedAddr
+	ln, err := net.Listen(protocol, listenAddress)
 	if err != nil {
 		log.Panicln(err)
 	}
 	defer ln.Close()
+	if advertisedAddress == "" {
+		log.Printf("Listening on %s, not advertising an address\n", listenAddress)
+	} else {
+		log.Printf("Listening on %s, advertising %s\n", listenAddress, advertisedAddress)
+	}
 
 	bc := NewBlockChain(nodeID)
-
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	mempool = NewMempool(bc)
+	syncManager = NewSyncManager(bc)
+	syncManager.Start()
+	peerManager = NewPeerManager(bc, seedNodes)
+	peerManager.Start()
+	if len(minerAddress) > 0 {
+		miner = NewMiner(bc, minerAddress)
+		miner.Start()
 	}
 
 	for {
@@ -431,7 +606,7 @@ func StartServer(nodeID, minerAddress string) {
 		if err != nil {
 			log.Panicln(err)
 		}
-		go handleConnection(conn, bc)
+		go peerManager.AddInbound(conn)
 	}
 }
 
@@ -446,11 +621,8 @@ func gobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func nodeIsKnown(add string) bool {
-	for _, node := range knownNodes {
-		if node == add {
-			return true
-		}
-	}
-	return false
+// gobDecode decodes a payload received from a peer. Unlike the Deserialize
+// helpers it returns an error, since peers can send anything.
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
 }
@@ -0,0 +1,47 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultAdvertisedAddr(t *testing.T) {
+	tests := []struct {
+		listen     string
+		advertised string
+	}{
+		{"localhost:3000", "localhost:3000"},
+		{"10.1.0.1:3000", "10.1.0.1:3000"},
+		// a wildcard listener has no address peers can dial
+		{":3000", ""},
+		{"0.0.0.0:3000", ""},
+		{"[::]:3000", ""},
+		{"localhost", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.advertised, defaultAdvertisedAddr(test.listen), "listening on %s", test.listen)
+	}
+}
+
+func TestIsOwnAddr(t *testing.T) {
+	oldListen, oldAdvertised := listenAddress, advertisedAddress
+	t.Cleanup(func() { listenAddress, advertisedAddress = oldListen, oldAdvertised })
+	listenAddress, advertisedAddress = "0.0.0.0:3000", "203.0.113.5:3000"
+
+	assert.True(t, isOwnAddr("0.0.0.0:3000"))
+	assert.True(t, isOwnAddr("203.0.113.5:3000"))
+	assert.False(t, isOwnAddr("203.0.113.5:3001"))
+
+	advertisedAddress = ""
+	assert.False(t, isOwnAddr(""), "an empty advertised address matches nothing")
+
+	// a stored address may turn out to be ours once the listen address changes
+	bc, _ := newTestChain(t)
+	pm := NewPeerManager(bc, []string{"10.1.0.1:3000"})
+	assert.Empty(t, pm.AddAddresses([]netAddress{newNetAddress(listenAddress, SFNodeNetwork)}, ""))
+	listenAddress = "10.1.0.1:3000"
+	assert.Equal(t, 1, pm.AddressCount())
+	pm.fillOutbound()
+	assert.Empty(t, pm.dialing, "our own address is not dialed")
+}
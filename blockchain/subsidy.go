@@ -0,0 +1,22 @@
+package blockchain
+
+// CalcBlockSubsidy returns the new coins a block at height may mint. The
+// reward starts at InitialSubsidy and halves every SubsidyHalvingInterval
+// blocks until it reaches zero.
+func CalcBlockSubsidy(height int) int {
+	halvings := height / activeNetParams.SubsidyHalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return activeNetParams.InitialSubsidy >> uint(halvings)
+}
+
+// CalcMaxSupply returns the total amount the subsidy schedule will ever mint
+func CalcMaxSupply() int {
+	interval := activeNetParams.SubsidyHalvingInterval
+	supply := 0
+	for height := 0; CalcBlockSubsidy(height) > 0; height += interval {
+		supply += CalcBlockSubsidy(height) * interval
+	}
+	return supply
+}
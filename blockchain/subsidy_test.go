@@ -0,0 +1,32 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalcBlockSubsidy(t *testing.T) {
+	params := activeNetParams
+	activeNetParams = &NetParams{InitialSubsidy: 10, SubsidyHalvingInterval: 150}
+	t.Cleanup(func() { activeNetParams = params })
+
+	tests := []struct {
+		height  int
+		subsidy int
+	}{
+		{0, 10},
+		{149, 10},
+		{150, 5},
+		{299, 5},
+		{300, 2},
+		{450, 1},
+		{599, 1},
+		{600, 0},
+		{150 * 64, 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.subsidy, CalcBlockSubsidy(test.height), "height %d", test.height)
+	}
+	assert.Equal(t, (10+5+2+1)*150, CalcMaxSupply())
+}
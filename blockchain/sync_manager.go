@@ -0,0 +1,447 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// maxHeadersPerMsg is the most headers sent in one headers message. A
+	// full message means the sender has more.
+	maxHeadersPerMsg = 2000
+	// maxBlocksInFlightPerPeer is how many blocks may be requested from one
+	// peer before it delivers any of them
+	maxBlocksInFlightPerPeer = 16
+	// blockStallTimeout is how long a peer may take to deliver a requested
+	// block before it is disconnected and the block is asked from another
+	blockStallTimeout = 30 * time.Second
+	// progressInterval throttles the sync progress log
+	progressInterval = 5 * time.Second
+	// unknownLatency is assumed for peers that have not answered a ping yet
+	unknownLatency = time.Second
+	// headerPruneInterval is how often stale header-only branches are
+	// dropped from the block index
+	headerPruneInterval = 10 * time.Minute
+)
+
+var ErrHeadersNotContinuous = errors.New("headers do not form a chain")
+
+// errHeadersLowWork rolls back headers that do not lead to a chain with
+// more work than ours. Peers on a weaker branch send them honestly.
+var errHeadersLowWork = errors.New("headers do not lead to more work than the chain tip")
+
+type blockRequest struct {
+	peer *Peer
+	time time.Time
+}
+
+type receivedBlock struct {
+	block *Block
+	peer  *Peer
+}
+
+// SyncManager brings the chain up to date headers first. It downloads and
+// validates the best header chain from one peer, then fetches the bodies
+// from every peer that has them, a few blocks per peer at a time, and
+// connects them in height order.
+type SyncManager struct {
+	bc *BlockChain
+
+	mu sync.Mutex
+	// headerTip is the best validated header, at or ahead of the chain tip
+	headerTip *blockNode
+	// syncPeer is the peer headers are downloaded from
+	syncPeer *Peer
+	// peerHeights is the best height each peer is known to have
+	peerHeights map[*Peer]int
+	// queue lists the blocks between the chain tip and headerTip that are
+	// not connected yet, in height order
+	queue     []*blockNode
+	requested map[string]*blockRequest
+	received  map[string]*receivedBlock
+
+	lastProgress time.Time
+}
+
+func NewSyncManager(bc *BlockChain) *SyncManager {
+	return &SyncManager{
+		bc:          bc,
+		headerTip:   bc.bestNode(),
+		peerHeights: make(map[*Peer]int),
+		requested:   make(map[string]*blockRequest),
+		received:    make(map[string]*receivedBlock),
+	}
+}
+
+// Start watches for peers that stall the download and prunes stale
+// headers until the process exits
+func (sm *SyncManager) Start() {
+	go func() {
+		lastPrune := time.Now()
+		for {
+			time.Sleep(blockStallTimeout / 3)
+			sm.checkStalls()
+			if time.Since(lastPrune) >= headerPruneInterval {
+				sm.pruneHeaders()
+				lastPrune = time.Now()
+			}
+		}
+	}()
+}
+
+// PeerVersion starts downloading headers from p when its chain has more
+// work than our best header and no other peer is being synced from
+func (sm *SyncManager) PeerVersion(p *Peer, best *blockNode) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.peerHeights[p] = best.Height
+	if sm.syncPeer != nil || !best.betterThan(sm.headerTip) {
+		return
+	}
+	sm.syncPeer = p
+	log.Printf("Syncing headers from %s, which is at height %d\n", p, best.Height)
+	sm.requestHeaders(p)
+}
+
+// RequestHeaders asks p for the headers following our best header, used
+// when p announces a block we do not know
+func (sm *SyncManager) RequestHeaders(p *Peer) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.requestHeaders(p)
+}
+
+func (sm *SyncManager) requestHeaders(p *Peer) {
+	var locator [][]byte
+	err := sm.bc.Db.View(func(tx *bolt.Tx) error {
+		locator = blockLocator(tx, sm.headerTip)
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	sendGetHeaders(p, locator, nil)
+}
+
+// HandleHeaders validates headers sent by p and stores them in the block
+// index. The returned error is the peer's fault.
+func (sm *SyncManager) HandleHeaders(p *Peer, headers []BlockHeader) error {
+	if len(headers) > maxHeadersPerMsg {
+		return fmt.Errorf("%d headers, limit %d", len(headers), maxHeadersPerMsg)
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if len(headers) == 0 {
+		sm.headersDone(p)
+		return nil
+	}
+
+	var last *blockNode
+	err := sm.bc.Db.Update(func(tx *bolt.Tx) error {
+		for i := range headers {
+			header := &headers[i]
+			if i > 0 && !bytes.Equal(header.PreBlockHash, headers[i-1].Hash) {
+				return ErrHeadersNotContinuous
+			}
+			node := getBlockNode(tx, header.Hash)
+			if node != nil && node.Invalid {
+				return rejectHeader(header, ErrInvalidChain, "")
+			}
+			if node == nil {
+				err := checkHeaderSanity(header)
+				if err != nil {
+					return err
+				}
+				err = checkHeaderContext(tx, header)
+				if err != nil {
+					return err
+				}
+				node = newHeaderNode(header, getBlockNode(tx, header.PreBlockHash))
+				putBlockNode(tx, node)
+			}
+			last = node
+		}
+		// a full message is followed by more headers, which may add the work
+		if len(headers) < maxHeadersPerMsg && !last.betterThan(tipNode(tx)) {
+			return errHeadersLowWork
+		}
+		return nil
+	})
+	if errors.Is(err, errHeadersLowWork) {
+		log.Printf("Ignoring %d headers from %s: %v\n", len(headers), p, err)
+		sm.headersDone(p)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if last.Height > sm.peerHeights[p] {
+		sm.peerHeights[p] = last.Height
+	}
+	if last.betterThan(sm.headerTip) {
+		sm.headerTip = last
+	}
+	if len(headers) == maxHeadersPerMsg {
+		err = sm.bc.Db.View(func(tx *bolt.Tx) error {
+			sendGetHeaders(p, blockLocator(tx, last), nil)
+			return nil
+		})
+		if err != nil {
+			log.Panicln(err)
+		}
+		return nil
+	}
+	sm.headersDone(p)
+	return nil
+}
+
+// pruneHeaders deletes the header-only entries of the block index that do
+// not lead to more work than the chain tip. Nothing downloads them once no
+// sync is under way, and keeping them would let peers fill the index with
+// cheap headers.
+func (sm *SyncManager) pruneHeaders() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.syncPeer != nil || len(sm.queue) > 0 {
+		return
+	}
+
+	var pruned int
+	err := sm.bc.Db.Update(func(tx *bolt.Tx) error {
+		tip := tipNode(tx)
+		keep := make(map[string]bool)
+		for node := sm.headerTip; node != nil && node.HeaderOnly; node = getBlockNode(tx, node.PreBlockHash) {
+			keep[string(node.Hash)] = true
+		}
+
+		index := tx.Bucket([]byte(blockIndexBucket))
+		var stale [][]byte
+		err := index.ForEach(func(k, v []byte) error {
+			node := deserializeBlockNode(v)
+			if node.HeaderOnly && !node.Invalid && !node.betterThan(tip) && !keep[string(k)] {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range stale {
+			err = index.Delete(hash)
+			if err != nil {
+				return err
+			}
+		}
+		pruned = len(stale)
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d headers of branches with less work than the chain tip\n", pruned)
+	}
+}
+
+// headersDone is called once p has sent all the headers it has
+func (sm *SyncManager) headersDone(p *Peer) {
+	if sm.syncPeer == p {
+		sm.syncPeer = nil
+		log.Printf("Headers synced to height %d\n", sm.headerTip.Height)
+	}
+	sm.scheduleBlocks()
+	sm.fillRequests()
+}
+
+// scheduleBlocks queues the blocks from the last downloaded ancestor of
+// headerTip up to headerTip
+func (sm *SyncManager) scheduleBlocks() {
+	var queue []*blockNode
+	err := sm.bc.Db.View(func(tx *bolt.Tx) error {
+		for node := sm.headerTip; node != nil && node.HeaderOnly; node = getBlockNode(tx, node.PreBlockHash) {
+			queue = append(queue, node)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+	for i, j := 0, len(queue)-1; i < j; i, j = i+1, j-1 {
+		queue[i], queue[j] = queue[j], queue[i]
+	}
+	sm.queue = queue
+}
+
+// fillRequests hands out queued blocks to peers that have them, up to
+// maxBlocksInFlightPerPeer each
+func (sm *SyncManager) fillRequests() {
+	inFlight := make(map[*Peer]int)
+	for _, req := range sm.requested {
+		inFlight[req.peer]++
+	}
+	batches := make(map[*Peer][][]byte)
+	defer func() {
+		for p, hashes := range batches {
+			sendGetData(p, "block", hashes)
+		}
+	}()
+
+	for _, node := range sm.queue {
+		key := hex.EncodeToString(node.Hash)
+		if sm.requested[key] != nil || sm.received[key] != nil {
+			continue
+		}
+		var best *Peer
+		var bestCost time.Duration
+		for p, height := range sm.peerHeights {
+			if height < node.Height || inFlight[p] >= maxBlocksInFlightPerPeer {
+				continue
+			}
+			cost := downloadCost(p, inFlight[p])
+			if best == nil || cost < bestCost {
+				best, bestCost = p, cost
+			}
+		}
+		if best == nil {
+			return
+		}
+		sm.requested[key] = &blockRequest{best, time.Now()}
+		inFlight[best]++
+		batches[best] = append(batches[best], node.Hash)
+	}
+}
+
+// downloadCost estimates how long p takes to deliver one more block on top
+// of the inFlight it already owes, so that fast peers get more requests
+func downloadCost(p *Peer, inFlight int) time.Duration {
+	latency := p.Latency()
+	if latency == 0 {
+		latency = unknownLatency
+	}
+	return time.Duration(inFlight+1) * latency
+}
+
+// HandleBlock takes a block that was requested during sync and connects
+// every queued block that is now complete. It reports false for blocks it
+// did not ask for, which the caller has to add itself.
+func (sm *SyncManager) HandleBlock(p *Peer, block *Block) bool {
+	sm.mu.Lock()
+	key := hex.EncodeToString(block.Hash)
+	req, ok := sm.requested[key]
+	if !ok || req.peer != p {
+		sm.mu.Unlock()
+		return false
+	}
+	delete(sm.requested, key)
+	sm.received[key] = &receivedBlock{block, p}
+
+	connected, offender, err := sm.connectQueued()
+	sm.fillRequests()
+	// blocks are only announced once the download caught up, peers that
+	// are behind sync from us themselves
+	caughtUp := err == nil && connected != nil && len(sm.queue) == 0
+	sm.mu.Unlock()
+
+	if caughtUp {
+		relayBlock(connected.Hash)
+	}
+
+	if err != nil {
+		log.Println(err)
+		var rejectErr *BlockRejectError
+		if errors.As(err, &rejectErr) && blockIsPunishable(rejectErr) {
+			peerManager.Misbehaving(offender, banScoreInvalidBlock, err.Error())
+		}
+	}
+	return true
+}
+
+// connectQueued adds the blocks at the front of the queue that have
+// arrived and returns the last one added. When one is invalid the rest of
+// the queue is dropped and the peer that sent it is returned with the
+// error.
+func (sm *SyncManager) connectQueued() (*Block, *Peer, error) {
+	var last *Block
+	for len(sm.queue) > 0 {
+		key := hex.EncodeToString(sm.queue[0].Hash)
+		received, ok := sm.received[key]
+		if !ok {
+			break
+		}
+		delete(sm.received, key)
+		sm.queue = sm.queue[1:]
+
+		update, err := sm.bc.AddBlock(received.block)
+		if err != nil {
+			sm.reset()
+			return last, received.peer, err
+		}
+		applyChainUpdate(update)
+		sm.reportProgress(received.block.Height)
+		last = received.block
+	}
+	return last, nil, nil
+}
+
+// reset abandons the current download after an invalid block. The header
+// chain is rebuilt from the next peer that announces more work.
+func (sm *SyncManager) reset() {
+	sm.queue = nil
+	sm.requested = make(map[string]*blockRequest)
+	sm.received = make(map[string]*receivedBlock)
+	sm.headerTip = sm.bc.bestNode()
+}
+
+func (sm *SyncManager) reportProgress(height int) {
+	target := sm.headerTip.Height
+	if height < target && time.Since(sm.lastProgress) < progressInterval {
+		return
+	}
+	sm.lastProgress = time.Now()
+	log.Printf("Sync progress: block %d of %d (%.1f%%)\n", height, target, 100*float64(height)/float64(target))
+}
+
+// PeerDisconnected returns the blocks requested from p to the queue
+func (sm *SyncManager) PeerDisconnected(p *Peer) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.peerHeights, p)
+	if sm.syncPeer == p {
+		sm.syncPeer = nil
+	}
+	for key, req := range sm.requested {
+		if req.peer == p {
+			delete(sm.requested, key)
+		}
+	}
+	sm.fillRequests()
+}
+
+// checkStalls disconnects peers that have not delivered a requested block
+// within blockStallTimeout
+func (sm *SyncManager) checkStalls() {
+	sm.mu.Lock()
+	stalled := make(map[*Peer]bool)
+	for _, req := range sm.requested {
+		if time.Since(req.time) > blockStallTimeout {
+			stalled[req.peer] = true
+		}
+	}
+	sm.mu.Unlock()
+
+	for p := range stalled {
+		log.Printf("Block download from %s stalled\n", p)
+		p.Disconnect()
+	}
+}
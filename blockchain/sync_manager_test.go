@@ -0,0 +1,53 @@
+package blockchain
+
+import (
+	"github.com/boltdb/bolt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadersNeedMoreWork(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	tip := mineOn(&genesis, nil, address, nil)
+	_, err = bc.AddBlock(tip)
+	assert.NoError(t, err)
+
+	sm := NewSyncManager(bc)
+	p := &Peer{sendQueue: make(chan outMessage, sendQueueSize), quit: make(chan struct{})}
+	indexed := func(block *Block) bool {
+		var node *blockNode
+		err := bc.Db.View(func(tx *bolt.Tx) error {
+			node = getBlockNode(tx, block.Hash)
+			return nil
+		})
+		assert.NoError(t, err)
+		return node != nil
+	}
+
+	// a branch no better than the chain tip is not stored
+	side1 := mineOn(&genesis, nil, address, tip)
+	assert.NoError(t, sm.HandleHeaders(p, []BlockHeader{*side1.Header()}))
+	assert.False(t, indexed(side1))
+
+	side2 := mineOn(side1, nil, address, nil)
+	assert.NoError(t, sm.HandleHeaders(p, []BlockHeader{*side1.Header(), *side2.Header()}))
+	assert.True(t, indexed(side2))
+	sm.pruneHeaders()
+	assert.True(t, indexed(side2), "the branch has the most work")
+
+	// once the chain overtakes the branch it is pruned
+	for i := 0; i < 2; i++ {
+		tip = mineOn(tip, nil, address, nil)
+		_, err = bc.AddBlock(tip)
+		assert.NoError(t, err)
+	}
+	sm.reset()
+	sm.pruneHeaders()
+	assert.False(t, indexed(side1))
+	assert.False(t, indexed(side2))
+	assert.True(t, indexed(tip))
+}
@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTimeOffset is the largest clock correction taken from peers. When the
+// network disagrees with the local clock by more, the local clock is kept.
+const maxTimeOffset = 70 * time.Minute
+
+// maxTimeSamples bounds how many peers contribute to the adjusted time.
+// Beyond it the oldest sample makes room for the new one.
+const maxTimeSamples = 200
+
+// medianTimeSource keeps the clock offset the latest peers reported in
+// their version messages and derives the network-adjusted time from their
+// median
+type medianTimeSource struct {
+	mu      sync.Mutex
+	offsets map[string]int64
+	// peers lists the peers in offsets, oldest sample first
+	peers []string
+}
+
+var timeSource = &medianTimeSource{offsets: make(map[string]int64)}
+
+// AddTimeSample records the timestamp a peer sent, once per peer address
+// while its sample is in the window
+func (m *medianTimeSource) AddTimeSample(peer string, timestamp int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.offsets[peer]; ok {
+		return
+	}
+	if len(m.peers) >= maxTimeSamples {
+		delete(m.offsets, m.peers[0])
+		m.peers = m.peers[1:]
+	}
+	offset := timestamp - time.Now().Unix()
+	m.offsets[peer] = offset
+	m.peers = append(m.peers, peer)
+	log.Printf("Added time sample of %ds from %s, adjusted time offset is now %ds\n", offset, peer, m.offset())
+}
+
+// Offset returns the median peer offset in seconds
+func (m *medianTimeSource) Offset() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.offset()
+}
+
+func (m *medianTimeSource) offset() int64 {
+	// the local clock counts as one sample
+	offsets := []int64{0}
+	for _, offset := range m.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	median := offsets[len(offsets)/2]
+	limit := int64(maxTimeOffset / time.Second)
+	if median > limit || median < -limit {
+		return 0
+	}
+	return median
+}
+
+// AdjustedTime returns the network-adjusted time as a unix timestamp
+func (m *medianTimeSource) AdjustedTime() int64 {
+	return time.Now().Unix() + m.Offset()
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeSampleWindow(t *testing.T) {
+	m := &medianTimeSource{offsets: make(map[string]int64)}
+	for i := 0; i < maxTimeSamples; i++ {
+		m.AddTimeSample(fmt.Sprintf("old%d", i), time.Now().Unix()+100)
+	}
+	assert.InDelta(t, 100, m.Offset(), 1)
+
+	// newer peers push the oldest samples out of the window
+	for i := 0; i < maxTimeSamples; i++ {
+		m.AddTimeSample(fmt.Sprintf("new%d", i), time.Now().Unix()-100)
+	}
+	assert.Len(t, m.offsets, maxTimeSamples)
+	assert.InDelta(t, -100, m.Offset(), 1)
+
+	m.AddTimeSample("new0", time.Now().Unix()+100)
+	assert.InDelta(t, -100, m.offsets["new0"], 1, "one sample per peer")
+}
+
+func TestTimeOffsetMedian(t *testing.T) {
+	limit := int64(maxTimeOffset / time.Second)
+	tests := []struct {
+		offsets []int64
+		median  int64
+	}{
+		{nil, 0},
+		{[]int64{60}, 60},
+		{[]int64{60, 30}, 30},
+		{[]int64{-60, -30, -10}, -10},
+		{[]int64{-60, -30, 10}, 0}, // the local clock counts as a sample
+		{[]int64{limit, limit}, limit},
+		{[]int64{limit + 1, limit + 1}, 0},
+		{[]int64{-limit - 1, -limit - 1}, 0},
+	}
+	for _, test := range tests {
+		m := &medianTimeSource{offsets: make(map[string]int64)}
+		for i, offset := range test.offsets {
+			m.offsets[fmt.Sprint(i)] = offset
+		}
+		assert.Equal(t, test.median, m.Offset(), "offsets %v", test.offsets)
+	}
+}
@@ -6,16 +6,17 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"go-blockchain/util"
 	"log"
 	"math/big"
 	"strings"
 )
 
-const subsidy = 10
-
 type Transaction struct {
 	ID   []byte
 	Vin  []TXInput
@@ -27,6 +28,25 @@ func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
+// SignalsReplacement reports whether tx opted in to being replaced in the
+// mempool, which any of its inputs can do with a low enough sequence
+func (tx Transaction) SignalsReplacement() bool {
+	for _, vin := range tx.Vin {
+		if vin.Sequence <= MaxReplaceableSequence {
+			return true
+		}
+	}
+	return false
+}
+
+// SigOpCount returns the number of signature checks verifying tx takes
+func (tx Transaction) SigOpCount() int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+	return len(tx.Vin)
+}
+
 func (tx Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
 	encoder := gob.NewEncoder(&encoded)
@@ -37,10 +57,37 @@ func (tx Transaction) Serialize() []byte {
 	return encoded.Bytes()
 }
 
+// hashData encodes tx for hashing. Unlike gob, whose output depends on the
+// order types were registered in the process, the result is the same on
+// every node.
+func (tx Transaction) hashData() []byte {
+	var data bytes.Buffer
+	writeBytes := func(b []byte) {
+		binary.Write(&data, binary.BigEndian, uint32(len(b)))
+		data.Write(b)
+	}
+
+	writeBytes(tx.ID)
+	binary.Write(&data, binary.BigEndian, uint32(len(tx.Vin)))
+	for _, vin := range tx.Vin {
+		writeBytes(vin.Txid)
+		binary.Write(&data, binary.BigEndian, int64(vin.Vout))
+		writeBytes(vin.Signature)
+		writeBytes(vin.PubKey)
+		binary.Write(&data, binary.BigEndian, vin.Sequence)
+	}
+	binary.Write(&data, binary.BigEndian, uint32(len(tx.Vout)))
+	for _, vout := range tx.Vout {
+		binary.Write(&data, binary.BigEndian, int64(vout.Value))
+		writeBytes(vout.PubKeyHash)
+	}
+	return data.Bytes()
+}
+
 func (tx *Transaction) Hash() []byte {
 	txCopy := *tx
 	txCopy.ID = []byte{}
-	hash := sha256.Sum256(txCopy.Serialize())
+	hash := sha256.Sum256(txCopy.hashData())
 	return hash[:]
 }
 
@@ -68,7 +115,10 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, preTXs map[string]Transact
 		if err != nil {
 			log.Panic(err)
 		}
-		sig := append(r.Bytes(), s.Bytes()...)
+		// padded to a fixed width, Verify splits the signature in half
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
 		tx.Vin[inID].Signature = sig
 
 		txCopy.Vin[inID].PubKey = nil
@@ -84,6 +134,7 @@ func (tx *Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("       Out: %d", input.Vout))
 		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
 		lines = append(lines, fmt.Sprintf("       PubKey: %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("       Sequence: %d", input.Sequence))
 	}
 
 	for i, output := range tx.Vout {
@@ -157,13 +208,39 @@ func (tx *Transaction) Verify(preTXs map[string]Transaction) bool {
 	return true
 }
 
-// NewCoinbaseTX creates a new coinbase transaction
-func NewCoinbaseTX(to, data string) *Transaction {
+// coinbaseScript builds the coinbase input data: the block height and an
+// extra nonce, 8 bytes each, followed by free-form data. The height makes
+// every coinbase, and so every coinbase txid, unique.
+func coinbaseScript(height int, extraNonce uint64, data string) []byte {
+	return bytes.Join([][]byte{
+		util.IntToHex(int64(height)),
+		util.IntToHex(int64(extraNonce)),
+		[]byte(data),
+	}, []byte{})
+}
+
+// CoinbaseHeight returns the block height committed to by a coinbase
+func (tx Transaction) CoinbaseHeight() (int, bool) {
+	if !tx.IsCoinbase() || len(tx.Vin[0].PubKey) < 16 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint64(tx.Vin[0].PubKey[:8])), true
+}
+
+// NewCoinbaseTX creates a new coinbase transaction for a block at height,
+// paying the block subsidy plus fees, the fees of the transactions in it
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s'", to)
 	}
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
+	var extraNonce [8]byte
+	_, err := rand.Read(extraNonce[:])
+	if err != nil {
+		log.Panicln(err)
+	}
+	script := coinbaseScript(height, binary.BigEndian.Uint64(extraNonce[:]), data)
+	txin := TXInput{[]byte{}, -1, nil, script, SequenceFinal}
+	txout := NewTXOutput(CalcBlockSubsidy(height)+fees, to)
 	tx := Transaction{
 		nil,
 		[]TXInput{txin},
@@ -174,18 +251,68 @@ func NewCoinbaseTX(to, data string) *Transaction {
 	return &tx
 }
 
-// NewUTXOTransaction create a new transaction
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewBumpedTransaction rebuilds tx, a replaceable transaction of wallet,
+// to pay fee in total instead. The difference is taken from output change,
+// which has to pay wallet, and the result spends the same outputs so it
+// replaces tx in the mempool.
+func NewBumpedTransaction(wallet *Wallet, tx *Transaction, change, fee int, UTXOSet *UTXOSet) (*Transaction, error) {
+	if !tx.SignalsReplacement() {
+		return nil, errors.New("transaction does not signal replacement")
+	}
+	oldFee, err := UTXOSet.CalcFee(tx)
+	if err != nil {
+		return nil, fmt.Errorf("transaction is confirmed or its inputs are spent: %w", err)
+	}
+	if fee <= oldFee {
+		return nil, fmt.Errorf("the new fee has to be higher than %d", oldFee)
+	}
+
+	if change < 0 || change >= len(tx.Vout) {
+		return nil, errors.New("transaction has no change to pay the fee from")
+	}
+	if !bytes.Equal(tx.Vout[change].PubKeyHash, HashPubKey(wallet.PublicKey)) {
+		return nil, fmt.Errorf("output %d does not pay the wallet", change)
+	}
+	extra := fee - oldFee
+	if tx.Vout[change].Value < extra {
+		return nil, fmt.Errorf("the change of %d cannot pay %d more", tx.Vout[change].Value, extra)
+	}
+
+	bumped := tx.TrimmedCopy()
+	bumped.Vout[change].Value -= extra
+	if bumped.Vout[change].Value == 0 {
+		bumped.Vout = append(bumped.Vout[:change], bumped.Vout[change+1:]...)
+	}
+	for i := range bumped.Vin {
+		bumped.Vin[i].Signature = nil
+	}
+	bumped.ID = bumped.Hash()
+	UTXOSet.Blockchain.SignTransaction(&bumped, wallet.PrivateKey)
+	return &bumped, nil
+}
+
+// changeOutput is the index of the change output of the transactions
+// NewUTXOTransaction builds, when they have one
+const changeOutput = 1
+
+// NewUTXOTransaction create a new transaction sending amount to the address
+// and leaving fee for the miner. A replaceable transaction can be replaced
+// in the mempool by one paying a higher fee.
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, replaceable bool, UTXOSet *UTXOSet) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
 	pubKeyHash := HashPubKey(wallet.PublicKey)
 
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
-	if acc < amount {
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if acc < amount+fee {
 		log.Panicln("ERROR: Not enough funds")
 	}
 
+	sequence := uint32(SequenceFinal)
+	if replaceable {
+		sequence = MaxReplaceableSequence
+	}
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		if err != nil {
@@ -197,14 +324,15 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 				Vout:      out,
 				Signature: nil,
 				PubKey:    wallet.PublicKey,
+				Sequence:  sequence,
 			}
 			inputs = append(inputs, input)
 		}
 	}
 	outputs = append(outputs, *NewTXOutput(amount, to))
 	from := fmt.Sprintf("%s", wallet.GetAddress())
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from)) // a change
 	}
 	tx := Transaction{
 		ID:   nil,
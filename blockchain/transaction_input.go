@@ -2,11 +2,21 @@ package blockchain
 
 import "bytes"
 
+const (
+	// SequenceFinal is the sequence of inputs that do not let their
+	// transaction be replaced in the mempool
+	SequenceFinal = 0xffffffff
+	// MaxReplaceableSequence is the highest sequence that lets the
+	// transaction be replaced by one paying a higher fee
+	MaxReplaceableSequence = 0xfffffffd
+)
+
 type TXInput struct {
 	Txid      []byte
 	Vout      int
 	Signature []byte
 	PubKey    []byte
+	Sequence  uint32
 }
 
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
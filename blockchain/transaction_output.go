@@ -28,8 +28,23 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
+// TXOutputs holds the unspent outputs of one transaction, keyed by their
+// index in the transaction so that partially spent entries keep their
+// original output numbers. Height is the block the transaction was mined in.
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs  map[int]TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// IsMature reports whether the outputs can be spent in a block at height.
+// Coinbase outputs have to wait CoinbaseMaturity blocks; the genesis reward
+// cannot be reorganized away and is spendable at once.
+func (outs TXOutputs) IsMature(height int) bool {
+	if !outs.Coinbase || outs.Height == 0 {
+		return true
+	}
+	return height-outs.Height >= activeNetParams.CoinbaseMaturity
 }
 
 func (outs TXOutputs) Serialize() []byte {
@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTransaction() Transaction {
+	return Transaction{
+		Vin:  []TXInput{{Txid: []byte{1, 2}, Vout: 1, Signature: []byte{3}, PubKey: []byte{4}}},
+		Vout: []TXOutput{{Value: 5, PubKeyHash: []byte{6}}},
+	}
+}
+
+func TestTransactionHash(t *testing.T) {
+	tx := testTransaction()
+	// a fixed vector: the ID may not depend on anything but the fields,
+	// or nodes disagree on it
+	assert.Equal(t, "09df9bf1cd279570dd125750b58a0562e2cd4608df12b0a3309b4eb3a6ccf57a", hex.EncodeToString(tx.Hash()))
+
+	tx.ID = []byte("not hashed")
+	assert.Equal(t, "09df9bf1cd279570dd125750b58a0562e2cd4608df12b0a3309b4eb3a6ccf57a", hex.EncodeToString(tx.Hash()))
+
+	mutations := []func(tx *Transaction){
+		func(tx *Transaction) { tx.Vin[0].Txid = []byte{1} },
+		func(tx *Transaction) { tx.Vin[0].Vout = 2 },
+		func(tx *Transaction) { tx.Vin[0].Signature = nil },
+		func(tx *Transaction) { tx.Vin[0].PubKey = []byte{4, 4} },
+		func(tx *Transaction) { tx.Vin[0].Sequence = SequenceFinal },
+		func(tx *Transaction) { tx.Vout[0].Value = 6 },
+		func(tx *Transaction) { tx.Vout[0].PubKeyHash = []byte{7} },
+		// length prefixes keep the fields apart
+		func(tx *Transaction) { tx.Vin[0].Signature, tx.Vin[0].PubKey = []byte{3, 4}, nil },
+		func(tx *Transaction) { tx.Vout = append(tx.Vout, TXOutput{}) },
+	}
+	for i, mutate := range mutations {
+		changed := testTransaction()
+		mutate(&changed)
+		assert.NotEqual(t, tx.Hash(), changed.Hash(), "mutation %d", i)
+	}
+}
+
+func TestHashTransactions(t *testing.T) {
+	tx := testTransaction()
+	block := &Block{Transactions: []*Transaction{&tx}}
+	root := block.HashTransactions()
+	assert.Equal(t, root, block.HashTransactions())
+
+	tx.Vout[0].Value = 6
+	assert.NotEqual(t, root, block.HashTransactions())
+}
+
+func TestSignatureWidth(t *testing.T) {
+	wallet := NewWallet()
+	assert.Len(t, wallet.PublicKey, 64)
+	parent := Transaction{ID: []byte{1}, Vout: []TXOutput{*NewTXOutput(5, string(wallet.GetAddress()))}}
+	prevTXs := map[string]Transaction{hex.EncodeToString(parent.ID): parent}
+
+	// about one signature in 128 has a short r or s, which Verify used to
+	// split in the wrong place
+	for i := 0; i < 500; i++ {
+		tx := Transaction{Vin: []TXInput{{Txid: parent.ID, Vout: 0, PubKey: wallet.PublicKey}}, Vout: []TXOutput{{Value: i}}}
+		tx.ID = tx.Hash()
+		tx.Sign(wallet.PrivateKey, prevTXs)
+		assert.Len(t, tx.Vin[0].Signature, 64)
+		assert.True(t, tx.Verify(prevTXs))
+	}
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const nodeKeyFile = "nodekey_%s.dat"
+
+// handshakeTimeout bounds the encrypted handshake of a new connection
+const handshakeTimeout = 10 * time.Second
+
+var ErrKeyNotAllowed = errors.New("node key is not on the allow-list")
+
+// transportKey is the static node key. Connections are encrypted when it
+// is set, which the TRANSPORT env does.
+var transportKey *ecdh.PrivateKey
+
+// allowedKeys are the node keys peers must have, any key is accepted when
+// it is empty
+var allowedKeys [][]byte
+
+// loadNodeKey reads the static node key of nodeID, creating it on first use
+func loadNodeKey(nodeID string) *ecdh.PrivateKey {
+	keyFile := fmt.Sprintf(nodeKeyFile, nodeID)
+	data, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			log.Panicln(err)
+		}
+		err = os.WriteFile(keyFile, key.Bytes(), 0600)
+		if err != nil {
+			log.Panicln(err)
+		}
+		return key
+	}
+	if err != nil {
+		log.Panicln(err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return key
+}
+
+// loadAllowedKeys reads hex encoded node keys, one per line. Blank lines
+// and lines starting with # are skipped.
+func loadAllowedKeys(path string) [][]byte {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer file.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != noiseKeyLength {
+			log.Panicf("invalid node key in %s: %q\n", path, line)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Panicln(err)
+	}
+	return keys
+}
+
+func keyAllowed(key []byte) bool {
+	if len(allowedKeys) == 0 {
+		return true
+	}
+	for _, allowed := range allowedKeys {
+		if sameKey(allowed, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupTransport runs the encrypted handshake on a new connection when
+// the transport is enabled, and checks the peer's node key against the
+// allow-list. The caller closes conn when it fails.
+func setupTransport(conn net.Conn, initiator bool) (net.Conn, error) {
+	if transportKey == nil {
+		return conn, nil
+	}
+
+	var prologue [4]byte
+	binary.BigEndian.PutUint32(prologue[:], activeNetParams.Net)
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	secure, err := noiseHandshake(conn, transportKey, initiator, prologue[:])
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if sameKey(secure.remoteKey, transportKey.PublicKey().Bytes()) {
+		return nil, ErrSelfConnect
+	}
+	if !keyAllowed(secure.remoteKey) {
+		return nil, fmt.Errorf("%w: %x", ErrKeyNotAllowed, secure.remoteKey)
+	}
+	log.Printf("Encrypted connection with %s, node key %x\n", conn.RemoteAddr(), secure.remoteKey)
+	return secure, nil
+}
@@ -0,0 +1,44 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+)
+
+const undoBucket = "undo"
+
+// spentOutput is an output removed from the chainstate by a block, kept so
+// the block can be disconnected again
+type spentOutput struct {
+	Txid     []byte
+	Vout     int
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// blockUndo holds everything needed to revert a block's chainstate changes
+type blockUndo struct {
+	Spent []spentOutput
+}
+
+func (u blockUndo) Serialize() []byte {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(u)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return buf.Bytes()
+}
+
+func deserializeUndo(data []byte) blockUndo {
+	var undo blockUndo
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&undo)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return undo
+}
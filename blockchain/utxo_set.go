@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"encoding/hex"
+	"fmt"
 	"github.com/boltdb/bolt"
 	"log"
 )
@@ -19,10 +20,14 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 	err := db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(utxoBucket))
 		c := bucket.Cursor()
+		spendHeight := tipNode(tx).Height + 1
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
+			if !outs.IsMature(spendHeight) {
+				continue
+			}
 
 			for outIdx, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
@@ -62,104 +67,134 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
-func (u UTXOSet) CountTransactions() int {
-	db := u.Blockchain.Db
-	counter := 0
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			counter++
+// FindBalance sums the outputs locked to pubKeyHash, split into those that
+// can be spent in the next block and coinbase rewards still maturing
+func (u UTXOSet) FindBalance(pubKeyHash []byte) (int, int) {
+	spendable, immature := 0, 0
+	err := u.Blockchain.Db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		c := bucket.Cursor()
+		spendHeight := tipNode(tx).Height + 1
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			for _, out := range outs.Outputs {
+				if !out.IsLockedWithKey(pubKeyHash) {
+					continue
+				}
+				if outs.IsMature(spendHeight) {
+					spendable += out.Value
+				} else {
+					immature += out.Value
+				}
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		log.Panicln(err)
 	}
-	return counter
+	return spendable, immature
 }
 
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.Db
-	bucketName := []byte(utxoBucket)
+// CalcFee returns the fee of tx: the value of the chainstate outputs it
+// spends minus the value of its own outputs
+func (u UTXOSet) CalcFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bolt.ErrBucketNotFound {
-			log.Panic(err)
+	fee := 0
+	err := u.Blockchain.Db.View(func(dbTx *bolt.Tx) error {
+		b := dbTx.Bucket([]byte(utxoBucket))
+		for _, vin := range tx.Vin {
+			outsBytes := b.Get(vin.Txid)
+			if outsBytes == nil {
+				return fmt.Errorf("input %x:%d is not in the UTXO set", vin.Txid, vin.Vout)
+			}
+			out, ok := DeserializeOutputs(outsBytes).Outputs[vin.Vout]
+			if !ok {
+				return fmt.Errorf("input %x:%d is not in the UTXO set", vin.Txid, vin.Vout)
+			}
+			fee += out.Value
 		}
-		_, err = tx.CreateBucket(bucketName)
-		if err != nil {
-			log.Panicln(err)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, out := range tx.Vout {
+		fee -= out.Value
+	}
+	return fee, nil
+}
+
+// CirculatingSupply sums the value of every unspent output
+func (u UTXOSet) CirculatingSupply() int {
+	supply := 0
+	err := u.Blockchain.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			for _, out := range DeserializeOutputs(v).Outputs {
+				supply += out.Value
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		log.Panicln(err)
 	}
-	UTXO := u.Blockchain.FindUTXO()
+	return supply
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
+func (u UTXOSet) CountTransactions() int {
+	db := u.Blockchain.Db
+	counter := 0
 
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
-			if err != nil {
-				log.Panicln(err)
-			}
-			err = b.Put(key, outs.Serialize())
-			if err != nil {
-				log.Panicln(err)
-			}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			counter++
 		}
 		return nil
 	})
 	if err != nil {
 		log.Panicln(err)
 	}
+	return counter
 }
 
-func (u UTXOSet) Update(block *Block) {
+// Reindex rebuilds the chainstate and the undo records by replaying the main
+// chain from genesis
+func (u UTXOSet) Reindex() {
 	db := u.Blockchain.Db
 
 	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updateOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updateOuts.Outputs = append(updateOuts.Outputs, out)
-						}
-					}
-
-					if len(updateOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panicln(err)
-						}
-					} else {
-						err := b.Put(vin.Txid, updateOuts.Serialize())
-						if err != nil {
-							log.Panicln(err)
-						}
-					}
-				}
+		for _, bucketName := range []string{utxoBucket, undoBucket, mainChainBucket} {
+			err := tx.DeleteBucket([]byte(bucketName))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				log.Panic(err)
 			}
-
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
-			err := b.Put(tx.ID, newOutputs.Serialize())
+			_, err = tx.CreateBucket([]byte(bucketName))
 			if err != nil {
 				log.Panicln(err)
 			}
 		}
+
+		blocks := tx.Bucket([]byte(blockBucket))
+		var chain []*Block
+		for hash := blocks.Get([]byte("l")); len(hash) > 0; {
+			block := DeSerializeBlock(blocks.Get(hash))
+			chain = append(chain, block)
+			hash = block.PreBlockHash
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			err := connectBlock(tx, chain[i])
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
@@ -167,36 +202,96 @@ func (u UTXOSet) Update(block *Block) {
 	}
 }
 
+// connectBlock validates the inputs of block against the chainstate, applies
+// the block to it and records the spent outputs in the undo bucket
+func connectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	view := make(map[string]TXOutputs)
+	var undo blockUndo
 
+	for _, t := range block.Transactions {
+		if b.Get(t.ID) != nil {
+			return rejectBlock(block, ErrDuplicateTx, "tx %x has unspent outputs", t.ID)
+		}
+		if t.IsCoinbase() {
+			continue
+		}
+		for _, vin := range t.Vin {
+			prevID := hex.EncodeToString(vin.Txid)
+			if _, ok := view[prevID]; !ok {
+				outsBytes := b.Get(vin.Txid)
+				if outsBytes == nil {
+					continue
+				}
+				view[prevID] = DeserializeOutputs(outsBytes)
+			}
+			outs := view[prevID]
+			if out, ok := outs.Outputs[vin.Vout]; ok {
+				undo.Spent = append(undo.Spent, spentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.Coinbase})
+			}
+		}
+	}
 
+	err := checkBlockInputs(block, view)
+	if err != nil {
+		return err
+	}
 
+	for txID, outs := range view {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if len(outs.Outputs) == 0 {
+			err = b.Delete(key)
+		} else {
+			err = b.Put(key, outs.Serialize())
+		}
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	err = tx.Bucket([]byte(undoBucket)).Put(block.Hash, undo.Serialize())
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = tx.Bucket([]byte(mainChainBucket)).Put(heightKey(block.Height), block.Hash)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return nil
+}
 
+// disconnectBlock reverts connectBlock using the block's undo record
+func disconnectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	undoData := tx.Bucket([]byte(undoBucket)).Get(block.Hash)
+	if undoData == nil {
+		return fmt.Errorf("no undo data for block %x, run reindexutxo", block.Hash)
+	}
+	undo := deserializeUndo(undoData)
 
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
+	for _, t := range block.Transactions {
+		err := b.Delete(t.ID)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	for _, spent := range undo.Spent {
+		outs := TXOutputs{make(map[int]TXOutput), spent.Height, spent.Coinbase}
+		outsBytes := b.Get(spent.Txid)
+		if outsBytes != nil {
+			outs = DeserializeOutputs(outsBytes)
+		}
+		outs.Outputs[spent.Vout] = spent.Output
+		err := b.Put(spent.Txid, outs.Serialize())
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	err := tx.Bucket([]byte(mainChainBucket)).Delete(heightKey(block.Height))
+	if err != nil {
+		log.Panicln(err)
+	}
+	return tx.Bucket([]byte(undoBucket)).Delete(block.Hash)
+}
@@ -0,0 +1,293 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+var (
+	ErrNoTransactions     = errors.New("block has no transactions")
+	ErrBlockTooBig        = errors.New("serialized block exceeds the size limit")
+	ErrTooManySigOps      = errors.New("block exceeds the signature operation limit")
+	ErrBadProofOfWork     = errors.New("proof of work is invalid")
+	ErrBadBlockHash       = errors.New("block hash does not commit to its header and merkle root")
+	ErrBadTxID            = errors.New("transaction id does not match its contents")
+	ErrDuplicateTx        = errors.New("transaction id is already in the block or the chainstate")
+	ErrNoInputs           = errors.New("transaction has no inputs")
+	ErrBadCoinbaseCount   = errors.New("block must contain exactly one coinbase")
+	ErrBadCoinbaseValue   = errors.New("coinbase pays more than the subsidy plus fees")
+	ErrBadCoinbaseHeight  = errors.New("coinbase does not commit to the block height")
+	ErrBadOutputValue     = errors.New("output value or total is out of the money range")
+	ErrBadInputValue      = errors.New("inputs total more than the money range")
+	ErrUnknownParent      = errors.New("parent block is unknown")
+	ErrInvalidChain       = errors.New("block is or descends from a block that failed to connect")
+	ErrBadHeight          = errors.New("height does not follow the parent block")
+	ErrBadDifficulty      = errors.New("difficulty does not match the retarget schedule")
+	ErrTimeTooOld         = errors.New("timestamp is not after the median time of the previous blocks")
+	ErrTimeTooNew         = errors.New("timestamp is too far in the future")
+	ErrMissingInput       = errors.New("input spends an output that does not exist or is already spent")
+	ErrImmatureSpend      = errors.New("input spends a coinbase that has not matured")
+	ErrDoubleSpend        = errors.New("output is spent twice in the block")
+	ErrBadSignature       = errors.New("input signature is invalid")
+	ErrOutputsExceedInput = errors.New("transaction spends more than its inputs")
+)
+
+// BlockRejectError is returned when a block fails validation. Reason is one
+// of the Err* values above so callers can match it with errors.Is.
+type BlockRejectError struct {
+	Hash   []byte
+	Reason error
+	Detail string
+}
+
+func (e *BlockRejectError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("block %x rejected: %v", e.Hash, e.Reason)
+	}
+	return fmt.Sprintf("block %x rejected: %v: %s", e.Hash, e.Reason, e.Detail)
+}
+
+func (e *BlockRejectError) Unwrap() error {
+	return e.Reason
+}
+
+func rejectBlock(block *Block, reason error, format string, args ...interface{}) error {
+	return &BlockRejectError{
+		Hash:   block.Hash,
+		Reason: reason,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+func rejectHeader(header *BlockHeader, reason error, format string, args ...interface{}) error {
+	return &BlockRejectError{
+		Hash:   header.Hash,
+		Reason: reason,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+// checkHeaderSanity checks the proof of work of header and that its hash
+// commits to it
+func checkHeaderSanity(header *BlockHeader) error {
+	pow := NewHeaderProofOfWork(header)
+	if !pow.Validate() {
+		return rejectHeader(header, ErrBadProofOfWork, "")
+	}
+	hash := sha256.Sum256(pow.PrepareData(header.Nonce))
+	if !bytes.Equal(hash[:], header.Hash) {
+		return rejectHeader(header, ErrBadBlockHash, "expected %x", hash)
+	}
+	return nil
+}
+
+// checkHeaderContext checks header against its parent in the block index,
+// which may itself be known by its header only
+func checkHeaderContext(tx *bolt.Tx, header *BlockHeader) error {
+	var parent *blockNode
+	if len(header.PreBlockHash) > 0 {
+		parent = getBlockNode(tx, header.PreBlockHash)
+	}
+	if parent == nil {
+		return rejectHeader(header, ErrUnknownParent, "parent %x", header.PreBlockHash)
+	}
+	if parent.Invalid {
+		return rejectHeader(header, ErrInvalidChain, "parent %x", header.PreBlockHash)
+	}
+	if header.Height != parent.Height+1 {
+		return rejectHeader(header, ErrBadHeight, "got %d, parent is at %d", header.Height, parent.Height)
+	}
+	expectedBits := calcNextBits(tx, parent)
+	if header.Bits != expectedBits {
+		return rejectHeader(header, ErrBadDifficulty, "got %08x, expected %08x", header.Bits, expectedBits)
+	}
+
+	medianTime := calcPastMedianTime(tx, parent)
+	if header.Timestamp <= medianTime {
+		return rejectHeader(header, ErrTimeTooOld, "got %d, median time past is %d", header.Timestamp, medianTime)
+	}
+	maxTime := timeSource.AdjustedTime() + int64(activeNetParams.MaxTimeDrift/time.Second)
+	if header.Timestamp > maxTime {
+		return rejectHeader(header, ErrTimeTooNew, "got %d, latest allowed is %d", header.Timestamp, maxTime)
+	}
+	return nil
+}
+
+// checkBlockSanity runs the checks that need nothing but the block itself
+func checkBlockSanity(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return rejectBlock(block, ErrNoTransactions, "")
+	}
+	size := len(block.Serialize())
+	if size > activeNetParams.MaxBlockSize {
+		return rejectBlock(block, ErrBlockTooBig, "%d bytes, limit %d", size, activeNetParams.MaxBlockSize)
+	}
+	sigOps := 0
+	for _, tx := range block.Transactions {
+		sigOps += tx.SigOpCount()
+	}
+	if sigOps > activeNetParams.MaxBlockSigOps {
+		return rejectBlock(block, ErrTooManySigOps, "%d, limit %d", sigOps, activeNetParams.MaxBlockSigOps)
+	}
+
+	err := checkHeaderSanity(block.Header())
+	if err != nil {
+		return err
+	}
+
+	coinbases := 0
+	seen := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+			return rejectBlock(block, ErrBadTxID, "tx %x", tx.ID)
+		}
+		txID := hex.EncodeToString(tx.ID)
+		if seen[txID] {
+			return rejectBlock(block, ErrDuplicateTx, "tx %x", tx.ID)
+		}
+		seen[txID] = true
+		if len(tx.Vin) == 0 {
+			return rejectBlock(block, ErrNoInputs, "tx %x", tx.ID)
+		}
+
+		if tx.IsCoinbase() {
+			coinbases++
+			height, ok := tx.CoinbaseHeight()
+			if !ok || height != block.Height {
+				return rejectBlock(block, ErrBadCoinbaseHeight, "tx %x", tx.ID)
+			}
+		}
+		if _, ok := sumOutputs(tx); !ok {
+			return rejectBlock(block, ErrBadOutputValue, "tx %x", tx.ID)
+		}
+	}
+	if coinbases != 1 {
+		return rejectBlock(block, ErrBadCoinbaseCount, "found %d", coinbases)
+	}
+	return nil
+}
+
+// validMoney reports whether v is an amount an output or a sum of outputs
+// may carry. Nothing can be worth more than the subsidy will ever mint.
+func validMoney(v int) bool {
+	return v >= 0 && v <= CalcMaxSupply()
+}
+
+// sumOutputs returns the total value of the outputs of tx. ok is false when
+// an output or the running total leaves the money range, which keeps the
+// sum from overflowing.
+func sumOutputs(tx *Transaction) (total int, ok bool) {
+	maxMoney := CalcMaxSupply()
+	for _, out := range tx.Vout {
+		if out.Value < 0 || out.Value > maxMoney || total > maxMoney-out.Value {
+			return 0, false
+		}
+		total += out.Value
+	}
+	return total, true
+}
+
+// unsignedHash recomputes a transaction ID. IDs are assigned before the
+// inputs are signed, so signatures are left out of the hash.
+func unsignedHash(tx *Transaction) []byte {
+	txCopy := tx.TrimmedCopy()
+	for i := range txCopy.Vin {
+		txCopy.Vin[i].Signature = nil
+	}
+	return txCopy.Hash()
+}
+
+// checkBlockContext checks block against its parent before it is stored.
+// Inputs are checked by connectBlock once the chainstate is at the parent.
+func checkBlockContext(tx *bolt.Tx, block *Block) error {
+	err := checkBlockSanity(block)
+	if err != nil {
+		return err
+	}
+
+	parentData := tx.Bucket([]byte(blockBucket)).Get(block.PreBlockHash)
+	if len(block.PreBlockHash) == 0 || parentData == nil {
+		return rejectBlock(block, ErrUnknownParent, "parent %x", block.PreBlockHash)
+	}
+	return checkHeaderContext(tx, block.Header())
+}
+
+// checkBlockInputs verifies every input of block against utxo, the unspent
+// outputs it spends as of the parent block. utxo is updated in place as
+// the block's transactions are applied in order.
+func checkBlockInputs(block *Block, utxo map[string]TXOutputs) error {
+	var coinbase *Transaction
+	fees := 0
+	spent := make(map[string]bool)
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			coinbase = tx
+		} else {
+			inputValue := 0
+			prevTXs := make(map[string]Transaction)
+
+			for _, vin := range tx.Vin {
+				prevID := hex.EncodeToString(vin.Txid)
+				outpoint := outpointKey(vin.Txid, vin.Vout)
+				if spent[outpoint] {
+					return rejectBlock(block, ErrDoubleSpend, "tx %x spends %s", tx.ID, outpoint)
+				}
+				out, ok := utxo[prevID].Outputs[vin.Vout]
+				if !ok {
+					return rejectBlock(block, ErrMissingInput, "tx %x spends %s", tx.ID, outpoint)
+				}
+				if !utxo[prevID].IsMature(block.Height) {
+					return rejectBlock(block, ErrImmatureSpend, "tx %x spends %s from height %d", tx.ID, outpoint, utxo[prevID].Height)
+				}
+				spent[outpoint] = true
+				if !vin.UsesKey(out.PubKeyHash) {
+					return rejectBlock(block, ErrBadSignature, "tx %x input key does not own %s", tx.ID, outpoint)
+				}
+				inputValue += out.Value
+				if !validMoney(inputValue) {
+					return rejectBlock(block, ErrBadInputValue, "tx %x", tx.ID)
+				}
+
+				prevTX, ok := prevTXs[prevID]
+				if !ok {
+					prevTX = Transaction{ID: vin.Txid}
+				}
+				for len(prevTX.Vout) <= vin.Vout {
+					prevTX.Vout = append(prevTX.Vout, TXOutput{})
+				}
+				prevTX.Vout[vin.Vout] = out
+				prevTXs[prevID] = prevTX
+				delete(utxo[prevID].Outputs, vin.Vout)
+			}
+
+			if !tx.Verify(prevTXs) {
+				return rejectBlock(block, ErrBadSignature, "tx %x", tx.ID)
+			}
+			// checkBlockSanity has bounded the outputs
+			outputValue, _ := sumOutputs(tx)
+			if outputValue > inputValue {
+				return rejectBlock(block, ErrOutputsExceedInput, "tx %x spends %d of %d", tx.ID, outputValue, inputValue)
+			}
+			fees += inputValue - outputValue
+		}
+
+		outs := TXOutputs{make(map[int]TXOutput), block.Height, tx.IsCoinbase()}
+		for outIdx, out := range tx.Vout {
+			outs.Outputs[outIdx] = out
+		}
+		utxo[hex.EncodeToString(tx.ID)] = outs
+	}
+
+	coinbaseValue, _ := sumOutputs(coinbase)
+	allowed := CalcBlockSubsidy(block.Height) + fees
+	if coinbaseValue > allowed {
+		return rejectBlock(block, ErrBadCoinbaseValue, "pays %d, allowed %d", coinbaseValue, allowed)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockRejectsDoubleSpend(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	utxo := UTXOSet{bc}
+	address := string(wallet.GetAddress())
+
+	tx1 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 0, false, &utxo)
+	tx2 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 4, 0, false, &utxo)
+	block := NewBlock([]*Transaction{tx1, tx2, NewCoinbaseTX(address, "", 1, 0)}, bc.Tip(), 1, activeNetParams.PowLimitBits, time.Now().Unix()+1)
+	_, err := bc.AddBlock(block)
+	assert.ErrorIs(t, err, ErrDoubleSpend)
+
+	unknown := &Transaction{ID: []byte("unknown"), Vout: []TXOutput{*NewTXOutput(5, address)}}
+	block = NewBlock([]*Transaction{spendOutput(wallet, unknown, 0, 0), NewCoinbaseTX(address, "", 1, 0)}, bc.Tip(), 1, activeNetParams.PowLimitBits, time.Now().Unix()+1)
+	_, err = bc.AddBlock(block)
+	assert.ErrorIs(t, err, ErrMissingInput)
+}
+
+func TestBlockTemplateSkipsConflicts(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	utxo := UTXOSet{bc}
+
+	tx1 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 0, false, &utxo)
+	tx2 := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 4, 0, false, &utxo)
+	txs := bc.NewBlockTemplate(string(wallet.GetAddress()), []*Transaction{tx1, tx2})
+	assert.Len(t, txs, 2)
+	assert.Equal(t, tx1, txs[0])
+
+	block, update, err := bc.MineBLock(txs)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Block{block}, update.Connected)
+	assert.Equal(t, block.Hash, bc.Tip())
+
+	// the template is stale once the tip moved, which is an error and not a panic
+	_, _, err = bc.MineBLock(txs)
+	assert.Error(t, err)
+	assert.Equal(t, block.Hash, bc.Tip())
+}
+
+func TestBlockRejectsOutputsOutOfRange(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	coinbase := genesis.Transactions[0]
+	address := string(wallet.GetAddress())
+	maxMoney := CalcMaxSupply()
+
+	tests := [][]int{
+		{-1},
+		{maxMoney + 1},
+		// each output is in range but the sum overflows to a small value
+		{math.MaxInt64, math.MaxInt64, 2},
+		{maxMoney, 1},
+	}
+	for _, values := range tests {
+		tx := Transaction{Vin: []TXInput{{Txid: coinbase.ID, Vout: 0, PubKey: wallet.PublicKey}}}
+		for _, value := range values {
+			tx.Vout = append(tx.Vout, TXOutput{value, HashPubKey(wallet.PublicKey)})
+		}
+		tx.ID = tx.Hash()
+		tx.Sign(wallet.PrivateKey, map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase})
+
+		block := NewBlock([]*Transaction{&tx, NewCoinbaseTX(address, "", 1, 0)}, bc.Tip(), 1, activeNetParams.PowLimitBits, time.Now().Unix()+1)
+		_, err := bc.AddBlock(block)
+		assert.ErrorIs(t, err, ErrBadOutputValue, "outputs %v", values)
+	}
+	assert.Equal(t, CalcBlockSubsidy(0), UTXOSet{bc}.CirculatingSupply())
+}
+
+func TestBlockRejectsTxWithoutInputs(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+
+	tx := Transaction{Vout: []TXOutput{*NewTXOutput(0, address)}}
+	tx.ID = tx.Hash()
+	block := NewBlock([]*Transaction{&tx, NewCoinbaseTX(address, "", 1, 0)}, bc.Tip(), 1, activeNetParams.PowLimitBits, time.Now().Unix()+1)
+	_, err := bc.AddBlock(block)
+	assert.ErrorIs(t, err, ErrNoInputs)
+	assert.Equal(t, CalcBlockSubsidy(0), UTXOSet{bc}.CirculatingSupply())
+}
+
+func TestMinerMinesMempool(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	funds := fundOutputs(t, bc, wallet, 2)
+	oldMempool, oldPeerManager := mempool, peerManager
+	t.Cleanup(func() { mempool, peerManager = oldMempool, oldPeerManager })
+	mempool = NewMempool(bc)
+	peerManager = NewPeerManager(bc, nil)
+
+	for vout := range funds.Vout {
+		assert.NoError(t, mempool.Add(spendOutput(wallet, funds, vout, 1)))
+	}
+	m := NewMiner(bc, string(wallet.GetAddress()))
+	assert.True(t, m.mineBlock())
+	assert.Equal(t, 2, bc.GetBestHeight())
+	assert.Equal(t, 0, mempool.Count())
+	assert.False(t, m.mineBlock(), "nothing left to mine")
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	params := activeNetParams
+	maturity := *params
+	maturity.CoinbaseMaturity = 2
+	activeNetParams = &maturity
+	t.Cleanup(func() { activeNetParams = params })
+
+	tests := []struct {
+		outs   TXOutputs
+		height int
+		mature bool
+	}{
+		{TXOutputs{Height: 5, Coinbase: false}, 5, true},
+		{TXOutputs{Height: 5, Coinbase: true}, 6, false},
+		{TXOutputs{Height: 5, Coinbase: true}, 7, true},
+		{TXOutputs{Height: 0, Coinbase: true}, 1, true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.mature, test.outs.IsMature(test.height), "%+v spent at %d", test.outs, test.height)
+	}
+
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	coinbase := NewCoinbaseTX(address, "", 1, 0)
+	_, _, err := bc.MineBLock([]*Transaction{coinbase})
+	assert.NoError(t, err)
+
+	spend := spendOutput(wallet, coinbase, 0, 0)
+	_, _, err = bc.MineBLock([]*Transaction{spend, NewCoinbaseTX(address, "", 2, 0)})
+	assert.ErrorIs(t, err, ErrImmatureSpend)
+	spendable, immature := UTXOSet{bc}.FindBalance(HashPubKey(wallet.PublicKey))
+	assert.Equal(t, CalcBlockSubsidy(0), spendable)
+	assert.Equal(t, CalcBlockSubsidy(1), immature)
+
+	_, _, err = bc.MineBLock([]*Transaction{NewCoinbaseTX(address, "", 2, 0)})
+	assert.NoError(t, err)
+	_, _, err = bc.MineBLock([]*Transaction{spend, NewCoinbaseTX(address, "", 3, 0)})
+	assert.NoError(t, err, "two blocks deep the coinbase can be spent")
+}
+
+func TestCoinbaseHeight(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+
+	short := NewCoinbaseTX(address, "", 1, 0)
+	short.Vin[0].PubKey = short.Vin[0].PubKey[:15]
+	tests := []struct {
+		tx     *Transaction
+		height int
+		ok     bool
+	}{
+		{NewCoinbaseTX(address, "", 0, 0), 0, true},
+		{NewCoinbaseTX(address, "", 1, 0), 1, true},
+		{NewCoinbaseTX(address, "", 150000, 0), 150000, true},
+		{short, 0, false},
+		{spendOutput(wallet, short, 0, 0), 0, false},
+	}
+	for _, test := range tests {
+		height, ok := test.tx.CoinbaseHeight()
+		assert.Equal(t, test.ok, ok)
+		assert.Equal(t, test.height, height)
+	}
+
+	for _, coinbase := range []*Transaction{NewCoinbaseTX(address, "", 2, 0), short} {
+		coinbase.ID = coinbase.Hash()
+		block := NewBlock([]*Transaction{coinbase}, bc.Tip(), 1, activeNetParams.PowLimitBits, time.Now().Unix()+1)
+		_, err := bc.AddBlock(block)
+		assert.ErrorIs(t, err, ErrBadCoinbaseHeight)
+	}
+}
+
+func TestBlockTimestampRules(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	maxDrift := int64(activeNetParams.MaxTimeDrift / time.Second)
+
+	tests := []struct {
+		timestamp int64
+		err       error
+	}{
+		{genesis.Timestamp, ErrTimeTooOld},
+		{timeSource.AdjustedTime() + maxDrift + 60, ErrTimeTooNew},
+		{genesis.Timestamp + 1, nil},
+	}
+	for _, test := range tests {
+		block := NewBlock([]*Transaction{NewCoinbaseTX(address, "", 1, 0)}, genesis.Hash, 1, activeNetParams.PowLimitBits, test.timestamp)
+		_, err := bc.AddBlock(block)
+		if test.err == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, test.err, "timestamp %d", test.timestamp)
+		}
+	}
+}
+
+func TestCoinbaseClaimsFees(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	spend := spendOutput(wallet, genesis.Transactions[0], 0, 3)
+	fee, err := UTXOSet{bc}.CalcFee(spend)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fee)
+
+	tests := []struct {
+		txs []*Transaction
+		fee int
+		err error
+	}{
+		{[]*Transaction{spend}, 4, ErrBadCoinbaseValue},
+		{nil, 1, ErrBadCoinbaseValue},
+		{[]*Transaction{spendOutput(wallet, genesis.Transactions[0], 0, -1)}, 0, ErrOutputsExceedInput},
+		{[]*Transaction{spend}, 3, nil},
+	}
+	for _, test := range tests {
+		txs := append(test.txs, NewCoinbaseTX(address, "", 1, test.fee))
+		_, _, err := bc.MineBLock(txs)
+		if test.err == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, test.err, "fee %d", test.fee)
+		}
+	}
+	assert.Equal(t, 2*CalcBlockSubsidy(0), UTXOSet{bc}.CirculatingSupply(), "fees move coins, they do not mint them")
+}
+
+func TestBlockLimits(t *testing.T) {
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	funds := fundOutputs(t, bc, wallet, 3)
+	var spends []*Transaction
+	for vout := range funds.Vout {
+		spends = append(spends, spendOutput(wallet, funds, vout, 0))
+	}
+
+	params := activeNetParams
+	t.Cleanup(func() { activeNetParams = params })
+	limited := *params
+	limited.MaxBlockSigOps = 2
+	activeNetParams = &limited
+
+	assert.Len(t, bc.NewBlockTemplate(address, spends), 3, "the template stops at the sigop limit")
+	_, _, err := bc.MineBLock(append(spends, NewCoinbaseTX(address, "", 2, 0)))
+	assert.ErrorIs(t, err, ErrTooManySigOps)
+
+	limited.MaxBlockSize = len(funds.Serialize())
+	assert.Len(t, bc.NewBlockTemplate(address, spends), 1, "only the coinbase fits")
+	_, _, err = bc.MineBLock([]*Transaction{spends[0], NewCoinbaseTX(address, "", 2, 0)})
+	assert.ErrorIs(t, err, ErrBlockTooBig)
+
+	limited = *params
+	_, _, err = bc.MineBLock(bc.NewBlockTemplate(address, spends))
+	assert.NoError(t, err)
+}
@@ -66,7 +66,10 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	if err != nil {
 		log.Panicln(err)
 	}
-	pubKey := append(private.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// coordinates are padded to a fixed width, Verify splits the key in half
+	pubKey := make([]byte, 64)
+	private.X.FillBytes(pubKey[:32])
+	private.PublicKey.Y.FillBytes(pubKey[32:])
 	return *private, pubKey
 }
 
@@ -12,11 +12,28 @@ const walletFile = "wallet_%s.dat"
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// Pending holds the replaceable transactions sent by the wallet, by
+	// hex ID, so their fee can be bumped until they confirm
+	Pending map[string]*PendingTx
+}
+
+// PendingTx is a replaceable transaction along with what bumpfee needs to
+// replace it
+type PendingTx struct {
+	Tx *Transaction
+	// From is the address that sent Tx and signs its replacement
+	From string
+	// Change is the index of the output paying the change back to From,
+	// or -1 when there is none
+	Change int
+	// Node is the address Tx was submitted to
+	Node string
 }
 
 func NewWallets(nodeID string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Pending = make(map[string]*PendingTx)
 	err := wallets.LoadFromFile(nodeID)
 	return &wallets, err
 }
@@ -62,6 +79,9 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 		log.Panicln(err)
 	}
 	ws.Wallets = wallets.Wallets
+	if wallets.Pending != nil {
+		ws.Pending = wallets.Pending
+	}
 	return nil
 }
 
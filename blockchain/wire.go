@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A message on the wire is a 24-byte header followed by the payload:
+//
+//	magic    uint32    network identifier, NetParams.Net
+//	command  [12]byte  zero-padded command name
+//	length   uint32    payload length
+//	checksum [4]byte   first 4 bytes of double SHA-256 of the payload
+const messageHeaderLength = 4 + commandLength + 4 + 4
+
+// maxMessagePayload bounds a single payload so a peer cannot make us
+// allocate arbitrary amounts of memory
+const maxMessagePayload = 4 * 1024 * 1024
+
+var (
+	ErrBadMagic        = errors.New("message is for another network")
+	ErrPayloadTooLarge = errors.New("message payload is too large")
+	ErrBadChecksum     = errors.New("message checksum does not match its payload")
+	ErrBadCommand      = errors.New("message command is malformed")
+)
+
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// writeMessage frames payload with the message header and writes it to w
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	if len(command) > commandLength {
+		return ErrBadCommand
+	}
+	if len(payload) > maxMessagePayload {
+		return ErrPayloadTooLarge
+	}
+
+	var header [messageHeaderLength]byte
+	binary.BigEndian.PutUint32(header[0:4], activeNetParams.Net)
+	copy(header[4:4+commandLength], commandToBytes(command))
+	binary.BigEndian.PutUint32(header[4+commandLength:8+commandLength], uint32(len(payload)))
+	copy(header[8+commandLength:], messageChecksum(payload))
+
+	_, err := w.Write(append(header[:], payload...))
+	return err
+}
+
+// readMessage reads one framed message from r. Any error means the stream
+// can no longer be trusted and the connection should be dropped.
+func readMessage(r io.Reader) (string, []byte, error) {
+	var header [messageHeaderLength]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) != activeNetParams.Net {
+		return "", nil, ErrBadMagic
+	}
+	rawCommand := header[4 : 4+commandLength]
+	if i := bytes.IndexByte(rawCommand, 0); i >= 0 && !allZero(rawCommand[i:]) || rawCommand[0] == 0 {
+		return "", nil, ErrBadCommand
+	}
+	command := bytesToCommand(rawCommand)
+	length := binary.BigEndian.Uint32(header[4+commandLength : 8+commandLength])
+	if length > maxMessagePayload {
+		return "", nil, fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(messageChecksum(payload), header[8+commandLength:]) {
+		return "", nil, ErrBadChecksum
+	}
+	return command, payload, nil
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payload := []byte("payload")
+
+	assert.NoError(t, writeMessage(&buf, "version", payload))
+	assert.NoError(t, writeMessage(&buf, "verack", nil))
+
+	command, got, err := readMessage(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "version", command)
+	assert.Equal(t, payload, got)
+
+	command, got, err = readMessage(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "verack", command)
+	assert.Empty(t, got)
+}
+
+func TestMalformedMessages(t *testing.T) {
+	frame := func() []byte {
+		var buf bytes.Buffer
+		assert.NoError(t, writeMessage(&buf, "tx", []byte("payload")))
+		return buf.Bytes()
+	}
+
+	badMagic := frame()
+	badMagic[0] ^= 0xff
+	_, _, err := readMessage(bytes.NewReader(badMagic))
+	assert.True(t, errors.Is(err, ErrBadMagic), "other network's magic is rejected")
+
+	badChecksum := frame()
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	_, _, err = readMessage(bytes.NewReader(badChecksum))
+	assert.True(t, errors.Is(err, ErrBadChecksum), "corrupted payload is rejected")
+
+	oversized := frame()
+	binary.BigEndian.PutUint32(oversized[4+commandLength:], maxMessagePayload+1)
+	_, _, err = readMessage(bytes.NewReader(oversized))
+	assert.True(t, errors.Is(err, ErrPayloadTooLarge), "oversized payload is rejected before reading it")
+
+	truncated := frame()
+	_, _, err = readMessage(bytes.NewReader(truncated[:len(truncated)-2]))
+	assert.Error(t, err, "truncated payload is an error")
+
+	assert.Equal(t, ErrBadCommand, writeMessage(&bytes.Buffer{}, "averylongcommand", nil))
+}